@@ -1,6 +1,12 @@
 package cmd
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
@@ -20,6 +26,7 @@ var agentInitCmd = &cobra.Command{
 	Args:  cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		pc := controller.NewPipelineController(cPath)
+		defer observeHook(pc, "init")()
 
 		update := pc.Init()
 		if update {
@@ -37,8 +44,31 @@ var agentWaitCmd = &cobra.Command{
 	Args:  cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		pc := controller.NewPipelineController(cPath)
+		defer observeHook(pc, "wait")()
+
+		skipped, err := pc.Wait(args, waitTimeout, dependencyPolicy)
+		if err != nil {
+			log.Fatalf("error waiting for groups: %v", err)
+		}
+
+		// the group is being stopped, exiting would start its tasks in the
+		// meantime
+		if skipped {
+			log.Info("group skipped, waiting for the allocation to be stopped")
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			<-ctx.Done()
+			return
+		}
 
-		pc.Wait(args)
+		if len(inputs) > 0 {
+			err = pc.DownloadInputs(context.Background(), inputs)
+			if err != nil {
+				log.Fatalf("error downloading inputs: %v", err)
+			}
+		}
 	},
 }
 
@@ -48,8 +78,9 @@ var agentNextCmd = &cobra.Command{
 	Args:  cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		pc := controller.NewPipelineController(cPath)
+		defer observeHook(pc, "next")()
 
-		update := pc.Next(args, dynamicTasks)
+		update := pc.Next(args, dynamicTasks, artifacts)
 		if update {
 			err := pc.UpdateJob()
 			if err != nil {
@@ -59,14 +90,58 @@ var agentNextCmd = &cobra.Command{
 	},
 }
 
+var agentPipelineCmd = &cobra.Command{
+	Use:   "pipeline",
+	Short: "Dispatch pipeline of task group and wait for it",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		pc := controller.NewPipelineController(cPath)
+		defer observeHook(pc, "pipeline")()
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		err := pc.RunPipeline(ctx)
+		if err != nil {
+			log.Fatalf("error running pipeline: %v", err)
+		}
+	},
+}
+
+// observeHook traces the hook and pushes its metrics once it finishes, also
+// when it exits through log.Fatal. The returned func is deferred by the hook.
+func observeHook(pc *controller.PipelineController, hook string) func() {
+	start := time.Now()
+	endSpan := pc.TraceHook(hook)
+
+	log.RegisterExitHandler(func() {
+		endSpan(false)
+		pc.PushMetrics(hook, start, false)
+	})
+
+	return func() {
+		endSpan(true)
+		pc.PushMetrics(hook, start, true)
+	}
+}
+
 var dynamicTasks string
+var waitTimeout time.Duration
+var dependencyPolicy string
+var inputs string
+var artifacts string
 
 func init() {
+	agentWaitCmd.Flags().DurationVar(&waitTimeout, "timeout", 0, "maximum time to wait, zero waits forever")
+	agentWaitCmd.Flags().StringVar(&dependencyPolicy, "dependency-policy", controller.DependencyPolicyFail, "what to do when a dependency fails (fail, skip, continue)")
+	agentWaitCmd.Flags().StringVar(&inputs, "inputs", "", "artifacts of previous task group(s) to download, as group or group:glob")
+	agentNextCmd.Flags().StringVar(&artifacts, "artifacts", "", "globs of files relative to alloc dir to upload as artifacts")
 	agentNextCmd.Flags().StringVar(&dynamicTasks, "dynamic-tasks", "", "glob of task files relative to alloc dir")
 
 	agentCmd.AddCommand(agentInitCmd)
 	agentCmd.AddCommand(agentWaitCmd)
 	agentCmd.AddCommand(agentNextCmd)
+	agentCmd.AddCommand(agentPipelineCmd)
 
 	rootCmd.AddCommand(agentCmd)
 }
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/hyperbadger/nomad-pipeline/pkg/controller"
+)
+
+var configCmd = &cobra.Command{
+	Use: "config",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the effective config, after applying defaults and env vars",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := controller.LoadConfig(cPath)
+		if err != nil {
+			log.Fatalf("error loading config: %v", err)
+		}
+
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+
+		err = enc.Encode(config.Redacted())
+		if err != nil {
+			log.Fatalf("error printing config: %v", err)
+		}
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configPrintCmd)
+
+	rootCmd.AddCommand(configCmd)
+}
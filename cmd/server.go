@@ -1,9 +1,12 @@
 package cmd
 
 import (
+	"context"
+
 	"github.com/spf13/cobra"
 
 	"github.com/hyperbadger/nomad-pipeline/pkg/api"
+	"github.com/hyperbadger/nomad-pipeline/pkg/controller"
 	"go.uber.org/zap"
 )
 
@@ -15,23 +18,91 @@ var serverCmd = &cobra.Command{
 
 		logger := _logger.Sugar()
 
-		ps, err := api.NewPipelineServer(logger)
+		config, err := controller.LoadConfig(cPath)
+		if err != nil {
+			logger.Fatalf("error loading config: %v", err)
+		}
+
+		// flags take precedence over the config file and env vars
+		if cmd.Flags().Changed("addr") {
+			config.Server.Addr = addr
+		}
+		if cmd.Flags().Changed("scheduler") {
+			config.Server.Scheduler = scheduler
+		}
+
+		shutdownTracing, err := controller.InitTracing(context.Background(), config.Tracing, "server")
+		if err != nil {
+			logger.Fatalf("error setting up tracing: %v", err)
+		}
+		defer shutdownTracing(context.Background())
+
+		ps, err := api.NewPipelineServer(logger, config)
+		if err != nil {
+			logger.Fatalf("error creating pipeline server: %v", err)
+		}
+
+		if config.Server.Scheduler {
+			sched, err := controller.NewScheduler(config)
+			if err != nil {
+				logger.Fatalf("error creating scheduler: %v", err)
+			}
+
+			go func() {
+				if err := sched.Run(context.Background()); err != nil {
+					logger.Fatalf("scheduler errored: %v", err)
+				}
+			}()
+		}
+
+		tw, err := controller.NewTimeoutWatcher(config)
 		if err != nil {
-			logger.Fatalf("error creating pipeline server: %w", err)
+			logger.Fatalf("error creating timeout watcher: %v", err)
 		}
 
-		srv := ps.NewHTTPServer(addr)
+		go func() {
+			if err := tw.Run(context.Background()); err != nil {
+				logger.Fatalf("timeout watcher errored: %v", err)
+			}
+		}()
+
+		go func() {
+			if err := ps.RunSchedules(context.Background()); err != nil {
+				logger.Fatalf("schedules errored: %v", err)
+			}
+		}()
 
-		if err := srv.ListenAndServe(); err != nil {
+		go func() {
+			if err := ps.RecordHistory(context.Background()); err != nil {
+				logger.Fatalf("run history errored: %v", err)
+			}
+		}()
+
+		go func() {
+			if err := ps.RunNotifications(context.Background()); err != nil {
+				logger.Fatalf("notifications errored: %v", err)
+			}
+		}()
+
+		srv := ps.NewHTTPServer(config.Server.Addr)
+
+		if tls := config.Server.TLS; tls.Enabled() {
+			err = srv.ListenAndServeTLS(tls.CertFile, tls.KeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil {
 			logger.Fatalf("server errored: %v", err)
 		}
 	},
 }
 
 var addr string
+var scheduler bool
 
 func init() {
 	serverCmd.Flags().StringVar(&addr, "addr", "127.0.0.1:4656", "address server will listen on")
+	serverCmd.Flags().BoolVar(&scheduler, "scheduler", false, "trigger task groups of jobs that opted in to server scheduling")
 
 	rootCmd.AddCommand(serverCmd)
 }
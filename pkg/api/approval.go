@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/hyperbadger/nomad-pipeline/pkg/controller"
+)
+
+type approvalRequest struct {
+	Approver string `json:"approver" binding:"required"`
+}
+
+type Approval struct {
+	JobID     string `json:"job_id"`
+	TaskGroup string `json:"task_group"`
+	State     string `json:"state"`
+	Approver  string `json:"approver"`
+}
+
+func (ps *PipelineServer) approveGroup(c *gin.Context) {
+	ps.decideApproval(c, controller.ApprovalApproved)
+}
+
+func (ps *PipelineServer) rejectGroup(c *gin.Context) {
+	ps.decideApproval(c, controller.ApprovalRejected)
+}
+
+// decideApproval releases or cancels a group waiting for approval, recording
+// who made the call.
+func (ps *PipelineServer) decideApproval(c *gin.Context, state string) {
+	jobID := c.Params.ByName("jobID")
+	group := c.Params.ByName("group")
+
+	var req approvalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		httpErr := NewError(
+			WithCode(http.StatusBadRequest),
+			WithType(ErrorTypeInvalidRequest),
+			WithMessage("error parsing approval, approver is required"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	njob, httpErr := ps.getJob(jobID)
+	if httpErr != nil {
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	tg := njob.full.LookupTaskGroup(group)
+	if tg == nil {
+		httpErr := NewError(
+			WithCode(http.StatusNotFound),
+			WithType(ErrorTypeNotFound),
+			WithMessage("task group not found"),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	if controller.ApprovalState(tg) != controller.ApprovalPending {
+		httpErr := NewError(
+			WithCode(http.StatusConflict),
+			WithType(ErrorTypeInvalidRequest),
+			WithMessage("task group isn't waiting for approval"),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	if state == controller.ApprovalApproved {
+		controller.ApproveGroup(tg, req.Approver)
+	} else {
+		controller.RejectGroup(tg, req.Approver)
+	}
+
+	// fails if a hook updated the job in the meantime, instead of undoing
+	// its update
+	_, _, err := ps.nomad.Jobs().RegisterOpts(
+		njob.full,
+		&nomad.RegisterOptions{
+			EnforceIndex: true,
+			ModifyIndex:  *njob.full.JobModifyIndex,
+		},
+		&nomad.WriteOptions{},
+	)
+	if err != nil {
+		httpErr := NewError(
+			WithType(ErrorTypeNomadUpstream),
+			WithMessage("error updating job"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	ps.logger.Infow("recorded approval", "job", jobID, "group", group, "state", state, "approver", req.Approver)
+
+	c.JSON(http.StatusOK, Approval{
+		JobID:     jobID,
+		TaskGroup: group,
+		State:     state,
+		Approver:  req.Approver,
+	})
+}
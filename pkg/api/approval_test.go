@@ -0,0 +1,204 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/hyperbadger/nomad-pipeline/pkg/controller"
+	"go.uber.org/zap"
+)
+
+func TestDecideApproval(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name          string
+		action        string
+		group         string
+		body          string
+		state         string
+		jobMissing    bool
+		registerFails bool
+		wantCode      int
+		// wantCount is the count of the group in the updated job, nil if the
+		// job isn't updated
+		wantCount *int
+		wantState string
+	}{
+		{
+			name:      "approve",
+			action:    "approve",
+			group:     "deploy",
+			body:      `{"approver": "jane"}`,
+			state:     controller.ApprovalPending,
+			wantCode:  http.StatusOK,
+			wantCount: intPtr(2),
+			wantState: controller.ApprovalApproved,
+		},
+		{
+			name:      "reject",
+			action:    "reject",
+			group:     "deploy",
+			body:      `{"approver": "jane"}`,
+			state:     controller.ApprovalPending,
+			wantCode:  http.StatusOK,
+			wantCount: intPtr(0),
+			wantState: controller.ApprovalRejected,
+		},
+		{
+			name:     "no approver",
+			action:   "approve",
+			group:    "deploy",
+			body:     `{}`,
+			state:    controller.ApprovalPending,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "group not found",
+			action:   "approve",
+			group:    "missing",
+			body:     `{"approver": "jane"}`,
+			state:    controller.ApprovalPending,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "not waiting for approval",
+			action:   "approve",
+			group:    "deploy",
+			body:     `{"approver": "jane"}`,
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "already approved",
+			action:   "reject",
+			group:    "deploy",
+			body:     `{"approver": "jane"}`,
+			state:    controller.ApprovalApproved,
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:       "job garbage collected",
+			action:     "approve",
+			group:      "deploy",
+			body:       `{"approver": "jane"}`,
+			jobMissing: true,
+			wantCode:   http.StatusNotFound,
+		},
+		{
+			name:          "job updated in the meantime",
+			action:        "approve",
+			group:         "deploy",
+			body:          `{"approver": "jane"}`,
+			state:         controller.ApprovalPending,
+			registerFails: true,
+			wantCode:      http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := map[string]string{
+				controller.TagApproval: "true",
+				controller.TagCount:    "2",
+			}
+			if len(tt.state) > 0 {
+				meta[controller.TagApprovalState] = tt.state
+			}
+
+			id, name, status := "example", "deploy", "dead"
+			zero, modifyIndex := 0, uint64(42)
+			job := &nomad.Job{
+				ID:             &id,
+				Name:           &id,
+				Status:         &status,
+				JobModifyIndex: &modifyIndex,
+				Meta:           map[string]string{controller.TagEnabled: "true"},
+				TaskGroups:     []*nomad.TaskGroup{{Name: &name, Count: &zero, Meta: meta}},
+			}
+
+			var registered *nomad.JobRegisterRequest
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case tt.jobMissing && strings.HasPrefix(r.URL.Path, "/v1/job/example"):
+					http.Error(w, "job not found", http.StatusNotFound)
+				case r.URL.Path == "/v1/job/example":
+					_ = json.NewEncoder(w).Encode(job)
+				case r.URL.Path == "/v1/job/example/summary":
+					_ = json.NewEncoder(w).Encode(nomad.JobSummary{JobID: id})
+				case r.Method == http.MethodPut && r.URL.Path == "/v1/jobs":
+					if tt.registerFails {
+						http.Error(w, "Enforcing job modify index 42: job exists with conflicting job modify index: 43", http.StatusInternalServerError)
+						return
+					}
+					registered = new(nomad.JobRegisterRequest)
+					_ = json.NewDecoder(r.Body).Decode(registered)
+					_ = json.NewEncoder(w).Encode(nomad.JobRegisterResponse{})
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+
+			nClient, err := nomad.NewClient(&nomad.Config{Address: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ps := PipelineServer{nomad: nClient, logger: zap.NewNop().Sugar()}
+			r := gin.New()
+			r.POST("/jobs/:jobID/groups/:group/approve", ps.approveGroup)
+			r.POST("/jobs/:jobID/groups/:group/reject", ps.rejectGroup)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/jobs/example/groups/"+tt.group+"/"+tt.action, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("%v: code = %v, want %v: %v", tt.action, w.Code, tt.wantCode, w.Body.String())
+			}
+
+			if tt.wantCount == nil {
+				if registered != nil {
+					t.Errorf("%v: updated the job, want no update", tt.action)
+				}
+				return
+			}
+			if registered == nil {
+				t.Fatalf("%v: didn't update the job", tt.action)
+			}
+
+			if !registered.EnforceIndex || registered.JobModifyIndex != modifyIndex {
+				t.Errorf("update isn't enforcing the job modify index %v", modifyIndex)
+			}
+
+			tg := registered.Job.LookupTaskGroup("deploy")
+			if *tg.Count != *tt.wantCount {
+				t.Errorf("count = %v, want %v", *tg.Count, *tt.wantCount)
+			}
+			if got := controller.ApprovalState(tg); got != tt.wantState {
+				t.Errorf("approval state = %q, want %q", got, tt.wantState)
+			}
+			if got := tg.Meta[controller.TagApprovalBy]; got != "jane" {
+				t.Errorf("approver = %q, want %q", got, "jane")
+			}
+
+			var approval Approval
+			if err := json.Unmarshal(w.Body.Bytes(), &approval); err != nil {
+				t.Fatal(err)
+			}
+			if approval.State != tt.wantState || approval.Approver != "jane" {
+				t.Errorf("response = %+v, want state %q by %q", approval, tt.wantState, "jane")
+			}
+		})
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -16,7 +16,11 @@ type Error struct {
 }
 
 const (
-	ErrorTypeNomadUpstream = "nomad_upstream"
+	ErrorTypeNomadUpstream  = "nomad_upstream"
+	ErrorTypeUnauthorized   = "unauthorized"
+	ErrorTypeNotFound       = "not_found"
+	ErrorTypeInvalidRequest = "invalid_request"
+	ErrorTypeInternal       = "internal"
 )
 
 type ErrorOption func(*Error)
@@ -0,0 +1,585 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/hyperbadger/nomad-pipeline/pkg/controller"
+	bolt "go.etcd.io/bbolt"
+)
+
+// group statuses, on top of the job statuses
+const (
+	GroupStatusPending = "pending"
+	GroupStatusRunning = "running"
+	GroupStatusNotRun  = "not_run"
+	GroupStatusSkipped = "skipped"
+
+	// groups gated by an approval, these are also used as job statuses when
+	// nothing else is left to run
+	GroupStatusAwaitingApproval = "awaiting_approval"
+	GroupStatusRejected         = "rejected"
+
+	// runs purged from Nomad before they were seen finishing
+	RunStatusPurged = "purged"
+)
+
+var runsBucket = []byte("runs")
+
+// Run is a pipeline job as recorded in the run history, it outlives the job
+// being garbage collected by Nomad.
+type Run struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	PipelineID string            `json:"pipeline_id,omitempty"`
+	Meta       map[string]string `json:"meta"`
+	Status     string            `json:"status"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+	// Duration is in seconds, up to now for runs that haven't finished
+	Duration   float64    `json:"duration"`
+	TaskGroups []GroupRun `json:"task_groups"`
+	ParentJob  string     `json:"parent_job,omitempty"`
+	ChildJobs  []string   `json:"child_jobs,omitempty"`
+
+	// CreateIndex tells apart jobs registered again under the same ID,
+	// ModifyIndex is used to skip jobs that haven't changed
+	CreateIndex uint64 `json:"create_index"`
+	ModifyIndex uint64 `json:"modify_index"`
+}
+
+// GroupRun is the outcome of a task group of a run.
+type GroupRun struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	TriggeredAt *time.Time `json:"triggered_at,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Duration    float64    `json:"duration"`
+	// QueueWait is the time in seconds between the group being triggered and
+	// its first task starting
+	QueueWait     float64 `json:"queue_wait,omitempty"`
+	Allocations   int     `json:"allocations"`
+	FailedIndexes []int   `json:"failed_indexes,omitempty"`
+}
+
+func (r *Run) finished() bool {
+	return r.FinishedAt != nil
+}
+
+// pipeline returns the pipeline the run was dispatched from, or the job for
+// runs that weren't dispatched.
+func (r *Run) pipeline() string {
+	if len(r.PipelineID) > 0 {
+		return r.PipelineID
+	}
+	return r.ID
+}
+
+// runKey keys runs by job ID and create index, so that a job registered
+// again after being purged is recorded as a separate run.
+func runKey(jobID string, createIndex uint64) []byte {
+	return []byte(fmt.Sprintf("%s@%020d", jobID, createIndex))
+}
+
+// historyStore keeps the run history in a bolt database in the data dir.
+type historyStore struct {
+	db *bolt.DB
+}
+
+func newHistoryStore(dataDir string) (*historyStore, error) {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating data dir: %w", err)
+	}
+
+	db, err := bolt.Open(filepath.Join(dataDir, "history.db"), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening history database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(runsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating history bucket: %w", err)
+	}
+
+	return &historyStore{db: db}, nil
+}
+
+func (s *historyStore) get(jobID string, createIndex uint64) (*Run, error) {
+	var run *Run
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(runsBucket).Get(runKey(jobID, createIndex))
+		if v == nil {
+			return nil
+		}
+
+		run = &Run{}
+		return json.Unmarshal(v, run)
+	})
+
+	return run, err
+}
+
+// latest returns the most recent run of the job, nil if there is none.
+func (s *historyStore) latest(jobID string) (*Run, error) {
+	var run *Run
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(jobID + "@")
+
+		// keys sort by create index, the last match is the latest run
+		c := tx.Bucket(runsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			run = &Run{}
+			if err := json.Unmarshal(v, run); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return run, err
+}
+
+func (s *historyStore) put(run Run) error {
+	rBytes, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(runsBucket).Put(runKey(run.ID, run.CreateIndex), rBytes)
+	})
+}
+
+// list returns the runs matching the filter, most recent first. A limit of
+// zero returns all runs.
+func (s *historyStore) list(filter func(Run) bool, limit int) ([]Run, error) {
+	runs := make([]Run, 0)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(runsBucket).ForEach(func(k, v []byte) error {
+			var run Run
+			if err := json.Unmarshal(v, &run); err != nil {
+				return err
+			}
+
+			if filter == nil || filter(run) {
+				runs = append(runs, run)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].StartedAt.After(runs[j].StartedAt) })
+
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+
+	return runs, nil
+}
+
+// prune deletes the finished runs that are older than the retention, and the
+// oldest finished runs past the max runs. Zero disables either.
+func (s *historyStore) prune(retention time.Duration, maxRuns int) (int, error) {
+	runs, err := s.list(nil, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-retention)
+
+	deleted := 0
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(runsBucket)
+
+		for i, run := range runs {
+			if !run.finished() {
+				continue
+			}
+
+			expired := retention > 0 && run.FinishedAt.Before(cutoff)
+			excess := maxRuns > 0 && i >= maxRuns
+			if !expired && !excess {
+				continue
+			}
+
+			if err := b.Delete(runKey(run.ID, run.CreateIndex)); err != nil {
+				return err
+			}
+			deleted++
+		}
+
+		return nil
+	})
+
+	return deleted, err
+}
+
+// RecordHistory records the runs of all pipeline jobs in the history every
+// poll interval and prunes the history every hour, until the context is done.
+func (ps *PipelineServer) RecordHistory(ctx context.Context) error {
+	ps.logger.Info("starting run history")
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	pruneTicker := time.NewTicker(time.Hour)
+	defer pruneTicker.Stop()
+
+	ps.recordRuns()
+	ps.pruneRuns()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			ps.recordRuns()
+		case <-pruneTicker.C:
+			ps.pruneRuns()
+		}
+	}
+}
+
+func (ps *PipelineServer) recordRuns() {
+	jobs, httpErr := ps.listJobs(notParam)
+	if httpErr != nil {
+		ps.logger.Errorw("error listing jobs for run history", "error", httpErr.Details)
+		return
+	}
+
+	seen := make(map[string]bool)
+
+	for _, njob := range jobs {
+		seen[string(runKey(njob.stub.ID, njob.stub.CreateIndex))] = true
+
+		recorded, err := ps.history.get(njob.stub.ID, njob.stub.CreateIndex)
+		if err != nil {
+			ps.logger.Errorw("error reading run history", "job", njob.stub.ID, "error", err)
+			continue
+		}
+
+		// finished runs only change if the job is changed
+		if recorded != nil && recorded.finished() && recorded.ModifyIndex == njob.stub.ModifyIndex {
+			continue
+		}
+
+		full, _, err := ps.nomad.Jobs().Info(njob.stub.ID, &nomad.QueryOptions{})
+		if err != nil {
+			ps.logger.Errorw("error getting job for run history", "job", njob.stub.ID, "error", err)
+			continue
+		}
+
+		if !isPipeline(full) {
+			continue
+		}
+		njob.full = full
+
+		run, err := ps.newRunFromNomadJob(njob)
+		if err != nil {
+			ps.logger.Errorw("error building run for run history", "job", njob.stub.ID, "error", err)
+			continue
+		}
+
+		err = ps.history.put(*run)
+		if err != nil {
+			ps.logger.Errorw("error saving run history", "job", njob.stub.ID, "error", err)
+			continue
+		}
+
+		observeRun(recorded, run)
+		ps.notifyRun(recorded, run)
+
+		if run.finished() && (recorded == nil || !recorded.finished()) {
+			traceRun(run)
+		}
+	}
+
+	unfinished, err := ps.history.list(func(run Run) bool {
+		return !run.finished() && !seen[string(runKey(run.ID, run.CreateIndex))]
+	}, 0)
+	if err != nil {
+		ps.logger.Errorw("error reading run history", "error", err)
+		return
+	}
+
+	for _, run := range unfinished {
+		prev := run
+
+		now := time.Now()
+		run.Status = RunStatusPurged
+		run.FinishedAt = &now
+
+		err = ps.history.put(run)
+		if err != nil {
+			ps.logger.Errorw("error saving run history", "job", run.ID, "error", err)
+			continue
+		}
+
+		ps.notifyRun(&prev, &run)
+	}
+}
+
+func (ps *PipelineServer) pruneRuns() {
+	cfg := ps.config.Server.History
+
+	deleted, err := ps.history.prune(cfg.Retention, cfg.MaxRuns)
+	if err != nil {
+		ps.logger.Errorw("error pruning run history", "error", err)
+		return
+	}
+
+	if deleted > 0 {
+		ps.logger.Infow("pruned run history", "deleted", deleted)
+	}
+}
+
+func nanoTime(ns int64) *time.Time {
+	t := time.Unix(0, ns)
+	return &t
+}
+
+// queueWait returns the time between the group being triggered and the first
+// of its tasks starting, zero if none started yet.
+func queueWait(tg *nomad.TaskGroup, allocs []*nomad.AllocationListStub, triggeredAt time.Time) time.Duration {
+	var started time.Time
+	for _, alloc := range allocs {
+		if alloc.TaskGroup != *tg.Name || time.Unix(0, alloc.CreateTime).Before(triggeredAt) {
+			continue
+		}
+
+		for _, state := range alloc.TaskStates {
+			if state.StartedAt.IsZero() {
+				continue
+			}
+			if started.IsZero() || state.StartedAt.Before(started) {
+				started = state.StartedAt
+			}
+		}
+	}
+
+	if started.IsZero() {
+		return 0
+	}
+
+	return started.Sub(triggeredAt)
+}
+
+func (ps *PipelineServer) newRunFromNomadJob(njob NomadJob) (*Run, error) {
+	job, httpErr := ps.newJobFromNomadJob(njob)
+	if httpErr != nil {
+		return nil, fmt.Errorf("%v: %v", httpErr.Message, httpErr.Details)
+	}
+
+	allocs, _, err := ps.nomad.Jobs().Allocations(njob.stub.ID, true, &nomad.QueryOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing job allocs: %w", err)
+	}
+
+	run := Run{
+		ID:          job.ID,
+		Name:        job.Name,
+		Meta:        njob.full.Meta,
+		Status:      job.Status,
+		ParentJob:   njob.full.Meta[controller.TagParentJob],
+		ChildJobs:   make([]string, 0),
+		CreateIndex: njob.stub.CreateIndex,
+		ModifyIndex: njob.stub.ModifyIndex,
+	}
+
+	if id, ok := njob.full.Meta[controller.TagParentPipeline]; ok {
+		run.PipelineID = id
+	}
+	if njob.full.ParentID != nil {
+		run.PipelineID = *njob.full.ParentID
+	}
+
+	if njob.full.SubmitTime != nil {
+		run.StartedAt = *nanoTime(*njob.full.SubmitTime)
+	}
+
+	var lastModified time.Time
+
+	for _, tg := range njob.full.TaskGroups {
+		if childJobs, ok := tg.Meta[controller.TagChildJobs]; ok {
+			for _, child := range strings.Split(childJobs, ",") {
+				run.ChildJobs = append(run.ChildJobs, strings.TrimSpace(child))
+			}
+		}
+
+		gRun := GroupRun{
+			Name:          *tg.Name,
+			FailedIndexes: controller.TgFailedIndexes(allocs, *tg.Name),
+		}
+
+		if triggeredAt, err := time.Parse(time.RFC3339Nano, tg.Meta[controller.TagTriggeredAt]); err == nil {
+			gRun.TriggeredAt = &triggeredAt
+
+			if wait := queueWait(tg, allocs, triggeredAt); wait > 0 {
+				gRun.QueueWait = wait.Seconds()
+			}
+		}
+
+		for _, alloc := range allocs {
+			if alloc.TaskGroup != *tg.Name {
+				continue
+			}
+
+			gRun.Allocations++
+
+			if created := nanoTime(alloc.CreateTime); gRun.StartedAt == nil || created.Before(*gRun.StartedAt) {
+				gRun.StartedAt = created
+			}
+			if modified := nanoTime(alloc.ModifyTime); gRun.FinishedAt == nil || modified.After(*gRun.FinishedAt) {
+				gRun.FinishedAt = modified
+			}
+		}
+
+		switch {
+		case len(tg.Meta[controller.TagDependencySkip]) > 0:
+			gRun.Status = GroupStatusSkipped
+		case gRun.Allocations == 0 && controller.Skipped(njob.full, *tg.Name):
+			gRun.Status = GroupStatusSkipped
+		case gRun.Allocations == 0 && controller.ApprovalState(tg) == controller.ApprovalPending:
+			gRun.Status = GroupStatusAwaitingApproval
+		case gRun.Allocations == 0 && controller.ApprovalState(tg) == controller.ApprovalRejected:
+			gRun.Status = GroupStatusRejected
+		case gRun.Allocations == 0 && njob.stub.Status != "dead":
+			gRun.Status = GroupStatusPending
+		case gRun.Allocations == 0:
+			gRun.Status = GroupStatusNotRun
+		case !controller.TgDone(allocs, []string{*tg.Name}, false):
+			gRun.Status = GroupStatusRunning
+			gRun.FinishedAt = nil
+		case len(tg.Meta[controller.TagTimedOut]) > 0:
+			gRun.Status = "timed_out"
+		case controller.TgSucceeded(njob.full, allocs, []string{*tg.Name}):
+			gRun.Status = "success"
+		default:
+			gRun.Status = "failed"
+		}
+
+		if gRun.StartedAt != nil {
+			end := time.Now()
+			if gRun.FinishedAt != nil {
+				end = *gRun.FinishedAt
+				if end.After(lastModified) {
+					lastModified = end
+				}
+			}
+			gRun.Duration = end.Sub(*gRun.StartedAt).Seconds()
+		}
+
+		run.TaskGroups = append(run.TaskGroups, gRun)
+	}
+
+	end := time.Now()
+	// a job waiting for approval has nothing running, but isn't finished
+	if njob.stub.Status == "dead" && run.Status != GroupStatusAwaitingApproval {
+		if !lastModified.IsZero() {
+			end = lastModified
+		}
+		run.FinishedAt = &end
+	}
+	if !run.StartedAt.IsZero() {
+		run.Duration = end.Sub(run.StartedAt).Seconds()
+	}
+
+	return &run, nil
+}
+
+func (ps *PipelineServer) listHistory(c *gin.Context) {
+	pipelineID := c.Query("pipeline")
+	if len(c.Params.ByName("pipelineID")) > 0 {
+		pipelineID = c.Params.ByName("pipelineID")
+	}
+	status := c.Query("status")
+
+	limit := 0
+	if l := c.Query("limit"); len(l) > 0 {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			httpErr := NewError(
+				WithCode(http.StatusBadRequest),
+				WithType(ErrorTypeInvalidRequest),
+				WithMessage("limit must be a positive integer"),
+			)
+			httpErr.Apply(c, ps.logger)
+			return
+		}
+	}
+
+	filter := func(run Run) bool {
+		if len(pipelineID) > 0 && run.PipelineID != pipelineID {
+			return false
+		}
+		if len(status) > 0 && run.Status != status {
+			return false
+		}
+		return true
+	}
+
+	runs, err := ps.history.list(filter, limit)
+	if err != nil {
+		httpErr := NewError(
+			WithType(ErrorTypeInternal),
+			WithMessage("error reading run history"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	c.JSON(http.StatusOK, runs)
+}
+
+func (ps *PipelineServer) getHistoryRun(c *gin.Context) {
+	jobID := c.Params.ByName("jobID")
+
+	run, err := ps.history.latest(jobID)
+	if err != nil {
+		httpErr := NewError(
+			WithType(ErrorTypeInternal),
+			WithMessage("error reading run history"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	if run == nil {
+		httpErr := NewError(
+			WithCode(http.StatusNotFound),
+			WithType(ErrorTypeNotFound),
+			WithMessage("run not found"),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	c.JSON(http.StatusOK, run)
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/hyperbadger/nomad-pipeline/pkg/controller"
+)
+
+// headers of the GitHub and GitLab webhooks
+const (
+	headerGitHubEvent     = "X-GitHub-Event"
+	headerGitHubSignature = "X-Hub-Signature-256"
+	headerGitLabEvent     = "X-Gitlab-Event"
+	headerGitLabToken     = "X-Gitlab-Token"
+)
+
+// maxHookPayload is the largest payload accepted by the hooks endpoint.
+const maxHookPayload = 10 << 20
+
+// validSignature checks a signature in the sha256=<hex digest> format against
+// the HMAC-SHA256 of the body.
+func validSignature(secret string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	actual, err := hex.DecodeString(sign(secret, body))
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(expected, actual)
+}
+
+// verifyHook checks that the request was sent by the configured source, and
+// returns false if the event isn't one that dispatches the pipeline.
+func verifyHook(cfg controller.WebhookConfig, c *gin.Context, body []byte) (bool, *Error) {
+	invalid := NewError(
+		WithCode(http.StatusUnauthorized),
+		WithType(ErrorTypeUnauthorized),
+		WithMessage("missing or invalid webhook signature"),
+	)
+
+	switch cfg.Type {
+	case controller.WebhookTypeGitHub:
+		if !validSignature(cfg.Secret, body, c.GetHeader(headerGitHubSignature)) {
+			return false, invalid
+		}
+		return c.GetHeader(headerGitHubEvent) == "push", nil
+	case controller.WebhookTypeGitLab:
+		// GitLab sends the secret as is instead of signing the payload
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader(headerGitLabToken)), []byte(cfg.Secret)) != 1 {
+			return false, invalid
+		}
+		return c.GetHeader(headerGitLabEvent) == "Push Hook", nil
+	default:
+		if !validSignature(cfg.Secret, body, c.GetHeader(HeaderSignature)) {
+			return false, invalid
+		}
+		return true, nil
+	}
+}
+
+// hookMeta builds the dispatch meta from the payload, using the JSONPath
+// mapping of the webhook. Paths not found in the payload are left out.
+func hookMeta(cfg controller.WebhookConfig, body []byte) (map[string]string, error) {
+	var payload interface{}
+
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&payload); err != nil {
+		return nil, fmt.Errorf("error parsing payload: %w", err)
+	}
+
+	meta := make(map[string]string)
+	for k, path := range cfg.Meta {
+		value, found, err := lookupJSONPath(payload, path)
+		if err != nil {
+			return nil, fmt.Errorf("error looking up meta (%v): %w", k, err)
+		}
+		if !found {
+			continue
+		}
+
+		meta[k], err = jsonValueString(value)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding meta (%v): %w", k, err)
+		}
+	}
+
+	return meta, nil
+}
+
+func (ps *PipelineServer) lookupWebhook(pipelineID string) (controller.WebhookConfig, bool) {
+	for _, cfg := range ps.config.Server.Webhooks {
+		if cfg.Pipeline == pipelineID {
+			return cfg, true
+		}
+	}
+	return controller.WebhookConfig{}, false
+}
+
+// triggerHook dispatches the pipeline from an inbound webhook. It isn't behind
+// the bearer token auth, the payload is verified with the secret of the
+// webhook instead.
+func (ps *PipelineServer) triggerHook(c *gin.Context) {
+	pipelineID := c.Params.ByName("pipelineID")
+
+	cfg, ok := ps.lookupWebhook(pipelineID)
+	if !ok {
+		httpErr := NewError(
+			WithCode(http.StatusNotFound),
+			WithType(ErrorTypeNotFound),
+			WithMessage("no webhook configured for pipeline"),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxHookPayload))
+	if err != nil {
+		httpErr := NewError(
+			WithCode(http.StatusBadRequest),
+			WithType(ErrorTypeInvalidRequest),
+			WithMessage("error reading payload"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	dispatch, httpErr := verifyHook(cfg, c, body)
+	if httpErr != nil {
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	// e.g. the ping event of GitHub, acknowledged so it isn't shown as failed
+	if !dispatch {
+		ps.logger.Infow("ignoring webhook event", "pipeline", pipelineID)
+		c.JSON(http.StatusOK, gin.H{"dispatched": false})
+		return
+	}
+
+	meta, err := hookMeta(cfg, body)
+	if err != nil {
+		httpErr := NewError(
+			WithCode(http.StatusBadRequest),
+			WithType(ErrorTypeInvalidRequest),
+			WithMessage("error mapping payload to meta"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	njob, httpErr := ps.getJob(pipelineID)
+	if httpErr != nil {
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	if !njob.full.IsParameterized() {
+		httpErr := NewError(
+			WithCode(http.StatusBadRequest),
+			WithType(ErrorTypeInvalidRequest),
+			WithMessage("only parameterized pipelines can be dispatched"),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	resp, _, err := ps.nomad.Jobs().Dispatch(pipelineID, meta, nil, &nomad.WriteOptions{})
+	if err != nil {
+		httpErr := NewError(
+			WithType(ErrorTypeNomadUpstream),
+			WithMessage("error dispatching pipeline"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	ps.logger.Infow("dispatched pipeline from webhook", "pipeline", pipelineID, "job", resp.DispatchedJobID)
+
+	c.JSON(http.StatusCreated, gin.H{"dispatched": true, "job_id": resp.DispatchedJobID})
+}
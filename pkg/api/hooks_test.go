@@ -0,0 +1,29 @@
+package api
+
+import "testing"
+
+func TestValidSignature(t *testing.T) {
+	secret := "It's a Secret to Everybody"
+	body := []byte("Hello, World!")
+
+	tests := []struct {
+		name      string
+		signature string
+		want      bool
+	}{
+		{name: "valid", signature: "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17", want: true},
+		{name: "wrong digest", signature: "sha256=857107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"},
+		{name: "missing prefix", signature: "757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"},
+		{name: "other algorithm", signature: "sha1=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"},
+		{name: "not hex", signature: "sha256=not-hex"},
+		{name: "empty", signature: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validSignature(secret, body, tt.signature); got != tt.want {
+				t.Errorf("validSignature(%q) = %v, want %v", tt.signature, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package api
 
 import (
+	"net/http"
+	"strings"
+
 	nomad "github.com/hashicorp/nomad/api"
 	"github.com/hyperbadger/nomad-pipeline/pkg/controller"
 )
@@ -28,15 +31,99 @@ type Job struct {
 	Status string `json:"status"`
 }
 
+type TaskGroup struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	// Tags are the nomad-pipeline tags of the group, including the ones
+	// inherited from the job level defaults
+	Tags map[string]string `json:"tags"`
+	// FailedIndexes are the allocation indexes of the group that finished
+	// unsuccessfully, a group can still succeed with failed allocations if
+	// it has a success threshold
+	FailedIndexes []int `json:"failed_indexes,omitempty"`
+}
+
+type JobDetail struct {
+	Job
+	Meta       map[string]string `json:"meta"`
+	TaskGroups []TaskGroup       `json:"task_groups"`
+	// ParentJob is the pipeline job that triggered this one, ChildJobs are
+	// the pipeline jobs triggered by this one
+	ParentJob string   `json:"parent_job,omitempty"`
+	ChildJobs []string `json:"child_jobs,omitempty"`
+}
+
+func (ps *PipelineServer) newJobDetailFromNomadJob(njob NomadJob) (*JobDetail, *Error) {
+	job, httpErr := ps.newJobFromNomadJob(njob)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+
+	allocs, _, err := ps.nomad.Jobs().Allocations(njob.stub.ID, true, &nomad.QueryOptions{})
+	if err != nil {
+		httpErr := NewError(
+			WithType(ErrorTypeNomadUpstream),
+			WithMessage("error listing job allocs"),
+			WithError(err),
+		)
+		return nil, httpErr
+	}
+
+	children := make([]string, 0)
+
+	tgs := make([]TaskGroup, 0, len(njob.full.TaskGroups))
+	for _, tg := range njob.full.TaskGroups {
+		if childJobs, ok := tg.Meta[controller.TagChildJobs]; ok {
+			for _, child := range strings.Split(childJobs, ",") {
+				children = append(children, strings.TrimSpace(child))
+			}
+		}
+
+		count := 0
+		if tg.Count != nil {
+			count = *tg.Count
+		}
+
+		tgs = append(tgs, TaskGroup{
+			Name:  *tg.Name,
+			Count: count,
+			Tags:  controller.GroupTags(njob.full, tg),
+
+			FailedIndexes: controller.TgFailedIndexes(allocs, *tg.Name),
+		})
+	}
+
+	detail := JobDetail{
+		Job:        *job,
+		Meta:       njob.full.Meta,
+		TaskGroups: tgs,
+		ParentJob:  njob.full.Meta[controller.TagParentJob],
+		ChildJobs:  children,
+	}
+
+	return &detail, nil
+}
+
 func (ps *PipelineServer) newJobFromNomadJob(njob NomadJob) (*Job, *Error) {
 	jobsAPI := ps.nomad.Jobs()
 
 	status := njob.stub.Status
 
-	if status == "dead" {
+	if len(controller.TimedOut(njob.full)) > 0 {
+		status = "timed_out"
+	} else if njob.full.Stop != nil && *njob.full.Stop {
+		status = "cancelled"
+	} else if status == "dead" && len(controller.AwaitingApproval(njob.full)) > 0 {
+		status = GroupStatusAwaitingApproval
+	} else if status == "dead" {
 		ftgs := make([]string, 0)
 
 		for tg, tgs := range njob.stub.JobSummary.Summary {
+			// groups skipped by their dependency policy didn't fail
+			if full := njob.full.LookupTaskGroup(tg); full != nil && len(full.Meta[controller.TagDependencySkip]) > 0 {
+				continue
+			}
+
 			runs := sumTGSummary(tgs)
 
 			if runs == 1 {
@@ -54,19 +141,21 @@ func (ps *PipelineServer) newJobFromNomadJob(njob NomadJob) (*Job, *Error) {
 					return nil, httpErr
 				}
 
-				if !controller.TgDone(allocs, []string{tg}, true) {
+				if !controller.TgSucceeded(njob.full, allocs, []string{tg}) {
 					ftgs = append(ftgs, tg)
 				}
-			} else {
+			} else if !controller.Skipped(njob.full, tg) {
 				ps.logger.Warnw("dead job without any runs", "job", njob.stub.ID, "taskgroup", tg)
 			}
 		}
 
 		if len(ftgs) > 0 {
 			status = "failed"
+		} else if len(controller.Rejected(njob.full)) > 0 {
+			status = GroupStatusRejected
+		} else {
+			status = "success"
 		}
-
-		status = "success"
 	}
 
 	job := Job{
@@ -78,6 +167,65 @@ func (ps *PipelineServer) newJobFromNomadJob(njob NomadJob) (*Job, *Error) {
 	return &job, nil
 }
 
+// nomadNotFound checks if the Nomad API responded with a 404, the API client
+// only returns the status code as part of the error message.
+func nomadNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "response code: 404")
+}
+
+func (ps *PipelineServer) getJob(jobID string) (*NomadJob, *Error) {
+	jobsAPI := ps.nomad.Jobs()
+
+	job, _, err := jobsAPI.Info(jobID, &nomad.QueryOptions{})
+	if err != nil {
+		if nomadNotFound(err) {
+			httpErr := NewError(
+				WithCode(http.StatusNotFound),
+				WithType(ErrorTypeNotFound),
+				WithMessage("job not found"),
+				WithError(err),
+			)
+			return nil, httpErr
+		}
+
+		httpErr := NewError(
+			WithType(ErrorTypeNomadUpstream),
+			WithMessage("error getting job"),
+			WithError(err),
+		)
+		return nil, httpErr
+	}
+
+	if !isPipeline(job) {
+		httpErr := NewError(
+			WithCode(http.StatusNotFound),
+			WithType(ErrorTypeNotFound),
+			WithMessage("job is not a pipeline"),
+		)
+		return nil, httpErr
+	}
+
+	summary, _, err := jobsAPI.Summary(jobID, &nomad.QueryOptions{})
+	if err != nil {
+		httpErr := NewError(
+			WithType(ErrorTypeNomadUpstream),
+			WithMessage("error getting job summary"),
+			WithError(err),
+		)
+		return nil, httpErr
+	}
+
+	stub := nomad.JobListStub{
+		ID:               *job.ID,
+		Name:             *job.Name,
+		Status:           *job.Status,
+		ParameterizedJob: job.IsParameterized(),
+		JobSummary:       summary,
+	}
+
+	return &NomadJob{stub: &stub, full: job}, nil
+}
+
 type getJobsFilter func(*nomad.Job) bool
 
 func isPipeline(job *nomad.Job) bool {
@@ -100,11 +248,14 @@ func isChild(ofParent ...string) getJobsFilter {
 			parentID = *job.ParentID
 		}
 
+		// runs triggered by another run are children of that run too
+		parentJob := job.Meta[controller.TagParentJob]
+
 		if len(ofParent) > 0 {
-			return parentID == ofParent[0]
+			return parentID == ofParent[0] || (len(parentJob) > 0 && parentJob == ofParent[0])
 		}
 
-		if len(parentID) > 0 {
+		if len(parentID) > 0 || len(parentJob) > 0 {
 			return true
 		}
 
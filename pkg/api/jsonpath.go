@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseJSONPath splits a JSONPath expression into its steps, object keys and
+// array indexes. Only the child operators are supported, in dot
+// ($.a.b) and bracket ($['a'][0]) notation.
+func parseJSONPath(path string) ([]interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("json path (%v) must start with $", path)
+	}
+
+	steps := make([]interface{}, 0)
+
+	rest := path[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("json path (%v) has an empty key", path)
+			}
+
+			steps = append(steps, rest[:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("json path (%v) has an unclosed bracket", path)
+			}
+
+			inner := rest[1:end]
+			rest = rest[end+1:]
+
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, inner[1:len(inner)-1])
+				continue
+			}
+
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("json path (%v) has an invalid index: %v", path, inner)
+			}
+			steps = append(steps, index)
+		default:
+			return nil, fmt.Errorf("json path (%v) is invalid at: %v", path, rest)
+		}
+	}
+
+	return steps, nil
+}
+
+// lookupJSONPath returns the value at the path in the decoded JSON document,
+// and if it was found.
+func lookupJSONPath(doc interface{}, path string) (interface{}, bool, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	value := doc
+	for _, step := range steps {
+		switch s := step.(type) {
+		case string:
+			obj, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false, nil
+			}
+			if value, ok = obj[s]; !ok {
+				return nil, false, nil
+			}
+		case int:
+			arr, ok := value.([]interface{})
+			if !ok || s >= len(arr) {
+				return nil, false, nil
+			}
+			value = arr[s]
+		}
+	}
+
+	return value, value != nil, nil
+}
+
+// jsonValueString turns a JSON value into a meta value, strings are used as is
+// and anything else as its JSON encoding.
+func jsonValueString(value interface{}) (string, error) {
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+
+	vBytes, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(vBytes), nil
+}
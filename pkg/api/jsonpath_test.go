@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []interface{}
+		wantErr bool
+	}{
+		{path: "$", want: []interface{}{}},
+		{path: "$.ref", want: []interface{}{"ref"}},
+		{path: "$.repository.full_name", want: []interface{}{"repository", "full_name"}},
+		{path: "$.commits[0].id", want: []interface{}{"commits", 0, "id"}},
+		{path: "$['head commit']", want: []interface{}{"head commit"}},
+		{path: `$["a.b"][12]`, want: []interface{}{"a.b", 12}},
+		{path: "ref", wantErr: true},
+		{path: "$.", wantErr: true},
+		{path: "$..ref", wantErr: true},
+		{path: "$.commits[0", wantErr: true},
+		{path: "$.commits[-1]", wantErr: true},
+		{path: "$.commits[*]", wantErr: true},
+		{path: "$ref", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := parseJSONPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseJSONPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseJSONPath(%q) = %#v, want %#v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupJSONPath(t *testing.T) {
+	var doc interface{}
+	payload := `{
+		"ref": "refs/heads/main",
+		"repository": {"full_name": "hyperbadger/nomad-pipeline", "private": false},
+		"commits": [{"id": "abc"}, {"id": "def"}],
+		"deleted": null
+	}`
+	if err := json.Unmarshal([]byte(payload), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path      string
+		want      interface{}
+		wantFound bool
+		wantErr   bool
+	}{
+		{path: "$.ref", want: "refs/heads/main", wantFound: true},
+		{path: "$.repository.private", want: false, wantFound: true},
+		{path: "$.commits[1].id", want: "def", wantFound: true},
+		{path: "$['repository']['full_name']", want: "hyperbadger/nomad-pipeline", wantFound: true},
+		{path: "$.commits[2].id"},
+		{path: "$.missing"},
+		{path: "$.ref.name"},
+		{path: "$.repository[0]"},
+		{path: "$.deleted"},
+		{path: "ref", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, found, err := lookupJSONPath(doc, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookupJSONPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if found != tt.wantFound {
+				t.Fatalf("lookupJSONPath(%q) found = %v, want %v", tt.path, found, tt.wantFound)
+			}
+			if found && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lookupJSONPath(%q) = %#v, want %#v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONValueString(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{name: "string", value: "main", want: "main"},
+		{name: "number", value: float64(42), want: "42"},
+		{name: "bool", value: true, want: "true"},
+		{name: "object", value: map[string]interface{}{"id": "abc"}, want: `{"id":"abc"}`},
+		{name: "array", value: []interface{}{"a", float64(1)}, want: `["a",1]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jsonValueString(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("jsonValueString(%#v) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
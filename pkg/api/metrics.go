@@ -0,0 +1,111 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/hyperbadger/nomad-pipeline/pkg/controller"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	runsStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: controller.MetricsNamespace,
+		Subsystem: "runs",
+		Name:      "started_total",
+		Help:      "Pipeline runs started.",
+	}, []string{"pipeline"})
+
+	runsSucceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: controller.MetricsNamespace,
+		Subsystem: "runs",
+		Name:      "succeeded_total",
+		Help:      "Pipeline runs that finished successfully.",
+	}, []string{"pipeline"})
+
+	runsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: controller.MetricsNamespace,
+		Subsystem: "runs",
+		Name:      "failed_total",
+		Help:      "Pipeline runs that failed or timed out.",
+	}, []string{"pipeline"})
+
+	groupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: controller.MetricsNamespace,
+		Subsystem: "group",
+		Name:      "duration_seconds",
+		Help:      "Duration of finished task groups.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 16),
+	}, []string{"pipeline", "group", "status"})
+
+	groupQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: controller.MetricsNamespace,
+		Subsystem: "group",
+		Name:      "queue_wait_seconds",
+		Help:      "Time between a task group being triggered and its first task starting.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 14),
+	}, []string{"pipeline", "group"})
+)
+
+func init() {
+	controller.MetricsRegistry.MustRegister(
+		runsStarted,
+		runsSucceeded,
+		runsFailed,
+		groupDuration,
+		groupQueueWait,
+	)
+}
+
+// finishedStatus checks if the status of a run or group is final.
+func finishedStatus(status string) bool {
+	switch status {
+	case "success", "failed", "timed_out", "cancelled", GroupStatusRejected:
+		return true
+	}
+	return false
+}
+
+// observeRun updates the run metrics with what changed since the run was
+// last recorded, prev is nil for runs seen for the first time.
+func observeRun(prev *Run, run *Run) {
+	pipeline := run.pipeline()
+
+	if prev == nil {
+		runsStarted.WithLabelValues(pipeline).Inc()
+	}
+
+	if finishedStatus(run.Status) && (prev == nil || !finishedStatus(prev.Status)) {
+		switch run.Status {
+		case "success":
+			runsSucceeded.WithLabelValues(pipeline).Inc()
+		case "failed", "timed_out":
+			runsFailed.WithLabelValues(pipeline).Inc()
+		}
+	}
+
+	prevStatus := make(map[string]string)
+	if prev != nil {
+		for _, g := range prev.TaskGroups {
+			prevStatus[g.Name] = g.Status
+		}
+	}
+
+	for _, g := range run.TaskGroups {
+		if !finishedStatus(g.Status) || finishedStatus(prevStatus[g.Name]) {
+			continue
+		}
+
+		groupDuration.WithLabelValues(pipeline, g.Name, g.Status).Observe(g.Duration)
+		if g.QueueWait > 0 {
+			groupQueueWait.WithLabelValues(pipeline, g.Name).Observe(g.QueueWait)
+		}
+	}
+}
+
+// metrics serves the nomad-pipeline metrics along with the Go runtime and
+// process metrics of the server.
+func (ps *PipelineServer) metrics() gin.HandlerFunc {
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, controller.MetricsRegistry}
+
+	return gin.WrapH(promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hyperbadger/nomad-pipeline/pkg/controller"
+)
+
+// headers of the webhook requests
+const (
+	HeaderEvent     = "X-Nomad-Pipeline-Event"
+	HeaderDelivery  = "X-Nomad-Pipeline-Delivery"
+	HeaderSignature = "X-Nomad-Pipeline-Signature"
+)
+
+// Notification is the payload of the webhooks.
+type Notification struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+	Pipeline  string    `json:"pipeline"`
+	Job       Job       `json:"job"`
+	// TaskGroup is set for group events
+	TaskGroup *NotificationGroup `json:"task_group,omitempty"`
+}
+
+type NotificationGroup struct {
+	Name          string `json:"name"`
+	Status        string `json:"status"`
+	FailedIndexes []int  `json:"failed_indexes,omitempty"`
+}
+
+// webhook queues the notifications of a webhook, so they are delivered in
+// order without holding up the run history.
+type webhook struct {
+	config controller.NotificationConfig
+	queue  chan Notification
+}
+
+func newWebhooks(configs []controller.NotificationConfig) []*webhook {
+	webhooks := make([]*webhook, 0, len(configs))
+	for _, cfg := range configs {
+		if cfg.Type != controller.NotificationTypeWebhook {
+			continue
+		}
+
+		webhooks = append(webhooks, &webhook{
+			config: cfg,
+			queue:  make(chan Notification, 100),
+		})
+	}
+	return webhooks
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the body.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify queues the notification for the webhooks that want its event.
+func (ps *PipelineServer) notify(n Notification) {
+	id, err := newID()
+	if err != nil {
+		ps.logger.Errorw("error generating notification id", "error", err)
+		return
+	}
+
+	n.ID = id
+	n.Timestamp = time.Now().UTC()
+
+	for _, wh := range ps.webhooks {
+		if !wh.config.Wants(n.Event) {
+			continue
+		}
+
+		select {
+		case wh.queue <- n:
+		default:
+			ps.logger.Warnw("notification queue full, dropping notification", "notification", wh.config.Name, "event", n.Event, "job", n.Job.ID)
+		}
+	}
+}
+
+// notifyRun sends the notifications for what changed since the run was last
+// recorded, prev is nil for runs seen for the first time.
+func (ps *PipelineServer) notifyRun(prev *Run, run *Run) {
+	if len(ps.webhooks) == 0 {
+		return
+	}
+
+	// runs that finished well before they were first seen, like the ones
+	// still in Nomad when the server first starts, are old news
+	if prev == nil && run.finished() && time.Since(*run.FinishedAt) > time.Hour {
+		return
+	}
+
+	job := Job{
+		ID:     run.ID,
+		Name:   run.Name,
+		Status: run.Status,
+	}
+
+	if prev == nil {
+		ps.notify(Notification{Event: controller.NotificationEventRunStarted, Pipeline: run.pipeline(), Job: job})
+	}
+
+	prevStatus := make(map[string]string)
+	if prev != nil {
+		for _, g := range prev.TaskGroups {
+			prevStatus[g.Name] = g.Status
+		}
+	}
+
+	for _, g := range run.TaskGroups {
+		failed := g.Status == "failed" || g.Status == "timed_out"
+		if !failed || prevStatus[g.Name] == g.Status {
+			continue
+		}
+
+		ps.notify(Notification{
+			Event:    controller.NotificationEventGroupFailed,
+			Pipeline: run.pipeline(),
+			Job:      job,
+			TaskGroup: &NotificationGroup{
+				Name:          g.Name,
+				Status:        g.Status,
+				FailedIndexes: g.FailedIndexes,
+			},
+		})
+	}
+
+	if !run.finished() || (prev != nil && prev.finished()) {
+		return
+	}
+
+	event := controller.NotificationEventRunCompleted
+	if run.Status == "cancelled" || run.Status == GroupStatusRejected || run.Status == RunStatusPurged {
+		event = controller.NotificationEventRunCancelled
+	}
+
+	ps.notify(Notification{Event: event, Pipeline: run.pipeline(), Job: job})
+}
+
+// RunNotifications delivers the queued notifications of every webhook, until
+// the context is done.
+func (ps *PipelineServer) RunNotifications(ctx context.Context) error {
+	ps.logger.Infow("starting notifications", "webhooks", len(ps.webhooks))
+
+	var wg sync.WaitGroup
+	for _, wh := range ps.webhooks {
+		wg.Add(1)
+		go func(wh *webhook) {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case n := <-wh.queue:
+					ps.deliver(ctx, wh, n)
+				}
+			}
+		}(wh)
+	}
+
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// deliver posts the notification to the webhook, retrying with backoff on
+// errors that may go away.
+func (ps *PipelineServer) deliver(ctx context.Context, wh *webhook, n Notification) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		ps.logger.Errorw("error encoding notification", "notification", wh.config.Name, "error", err)
+		return
+	}
+
+	retry := ps.config.Retry
+
+	for attempt := 1; ; attempt++ {
+		retryable, err := ps.post(ctx, wh, n, body)
+		if err == nil {
+			ps.logger.Debugw("delivered notification", "notification", wh.config.Name, "event", n.Event, "id", n.ID)
+			return
+		}
+
+		if !retryable || (retry.MaxRetries > 0 && attempt > retry.MaxRetries) {
+			ps.logger.Errorw("error delivering notification, giving up", "notification", wh.config.Name, "event", n.Event, "id", n.ID, "attempts", attempt, "error", err)
+			return
+		}
+
+		backoff := controller.BackoffDuration(retry.MinBackoff, retry.MaxBackoff, attempt)
+		ps.logger.Warnw("error delivering notification, retrying", "notification", wh.config.Name, "event", n.Event, "id", n.ID, "backoff", backoff, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// post sends the notification once, the returned bool tells if a failed
+// delivery is worth retrying.
+func (ps *PipelineServer) post(ctx context.Context, wh *webhook, n Notification, body []byte) (bool, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, wh.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, n.Event)
+	req.Header.Set(HeaderDelivery, n.ID)
+	if len(wh.config.Secret) > 0 {
+		req.Header.Set(HeaderSignature, "sha256="+sign(wh.config.Secret, body))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	// other client errors won't go away by trying again
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+
+	return retryable, fmt.Errorf("webhook responded with status: %v", resp.Status)
+}
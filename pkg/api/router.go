@@ -1,33 +1,52 @@
 package api
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
 	nomad "github.com/hashicorp/nomad/api"
+	"github.com/hyperbadger/nomad-pipeline/pkg/controller"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 	"go.uber.org/zap"
 )
 
 type PipelineServer struct {
-	nomad  *nomad.Client
-	logger *zap.SugaredLogger
+	nomad     *nomad.Client
+	config    *controller.Config
+	logger    *zap.SugaredLogger
+	schedules *scheduleStore
+	history   *historyStore
+	webhooks  []*webhook
 }
 
-func NewPipelineServer(logger *zap.SugaredLogger) (*PipelineServer, error) {
-	nClient, err := nomad.NewClient(&nomad.Config{
-		Address: os.Getenv("NOMAD_ADDR"),
-	})
+func NewPipelineServer(logger *zap.SugaredLogger, config *controller.Config) (*PipelineServer, error) {
+	nClient, err := config.Nomad.NewClient()
 	if err != nil {
 		return nil, fmt.Errorf("error creating client: %w", err)
 	}
 
+	schedules, err := newScheduleStore(config.Server.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("error loading schedules: %w", err)
+	}
+
+	history, err := newHistoryStore(config.Server.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("error opening run history: %w", err)
+	}
+
 	ps := PipelineServer{
-		nomad:  nClient,
-		logger: logger,
+		nomad:     nClient,
+		config:    config,
+		logger:    logger,
+		schedules: schedules,
+		history:   history,
+		webhooks:  newWebhooks(config.Notifications),
 	}
 
 	return &ps, nil
@@ -38,16 +57,40 @@ func (ps *PipelineServer) NewHTTPServer(addr string) *http.Server {
 
 	r := gin.New()
 
+	// dispatched job ids contain a slash, which has to be escaped in paths
+	r.UseRawPath = true
+
 	desugar := ps.logger.Desugar()
 
 	// logging
 	r.Use(ginzap.Ginzap(desugar, time.RFC3339, true))
 	r.Use(ginzap.RecoveryWithZap(desugar, true))
 
+	if ps.config.Tracing.Enabled() {
+		r.Use(otelgin.Middleware("nomad-pipeline"))
+	}
+
 	r.GET("/health", ps.health)
-	r.GET("/jobs", ps.listAllJobs)
-	r.GET("/pipelines", ps.listPipelines)
-	r.GET("/pipelines/:pipelineID/jobs", ps.listPipelineJobs)
+
+	// webhooks are verified with their own secret
+	r.POST("/hooks/:pipelineID", ps.triggerHook)
+
+	authed := r.Group("/")
+	authed.Use(ps.auth)
+
+	authed.GET("/metrics", ps.metrics())
+	authed.GET("/jobs", ps.listAllJobs)
+	authed.GET("/jobs/:jobID", ps.getJobDetail)
+	authed.POST("/jobs/:jobID/groups/:group/approve", ps.approveGroup)
+	authed.POST("/jobs/:jobID/groups/:group/reject", ps.rejectGroup)
+	authed.GET("/history", ps.listHistory)
+	authed.GET("/history/:jobID", ps.getHistoryRun)
+	authed.GET("/pipelines", ps.listPipelines)
+	authed.GET("/pipelines/:pipelineID/jobs", ps.listPipelineJobs)
+	authed.GET("/pipelines/:pipelineID/history", ps.listHistory)
+	authed.GET("/pipelines/:pipelineID/schedules", ps.listSchedules)
+	authed.POST("/pipelines/:pipelineID/schedules", ps.createSchedule)
+	authed.DELETE("/pipelines/:pipelineID/schedules/:scheduleID", ps.deleteSchedule)
 
 	srv := http.Server{
 		Addr:    addr,
@@ -57,6 +100,33 @@ func (ps *PipelineServer) NewHTTPServer(addr string) *http.Server {
 	return &srv
 }
 
+// auth checks the bearer token against the configured tokens, all requests
+// are allowed when no tokens are configured.
+func (ps *PipelineServer) auth(c *gin.Context) {
+	tokens := ps.config.Server.Auth.Tokens
+	if len(tokens) == 0 {
+		c.Next()
+		return
+	}
+
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			c.Next()
+			return
+		}
+	}
+
+	httpErr := NewError(
+		WithCode(http.StatusUnauthorized),
+		WithType(ErrorTypeUnauthorized),
+		WithMessage("missing or invalid bearer token"),
+	)
+	httpErr.Apply(c, ps.logger)
+	c.Abort()
+}
+
 func (ps *PipelineServer) health(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"healthy": true})
 }
@@ -88,6 +158,24 @@ func (ps *PipelineServer) listAllJobs(c *gin.Context) {
 	c.JSON(http.StatusOK, allJobs)
 }
 
+func (ps *PipelineServer) getJobDetail(c *gin.Context) {
+	jobID := c.Params.ByName("jobID")
+
+	njob, httpErr := ps.getJob(jobID)
+	if httpErr != nil {
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	detail, httpErr := ps.newJobDetailFromNomadJob(*njob)
+	if httpErr != nil {
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	c.JSON(http.StatusOK, detail)
+}
+
 func (ps *PipelineServer) listPipelines(c *gin.Context) {
 	paramJobs, httpErr := ps.listJobs(isParam)
 	if httpErr != nil {
@@ -0,0 +1,477 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/cronexpr"
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+// what happens when a schedule is due while its previous run is still running
+const (
+	OverlapSkip  = "skip"
+	OverlapQueue = "queue"
+	OverlapAllow = "allow"
+)
+
+// Schedule dispatches a pipeline on a cron schedule.
+type Schedule struct {
+	ID         string            `json:"id"`
+	PipelineID string            `json:"pipeline_id"`
+	Cron       string            `json:"cron"`
+	Timezone   string            `json:"timezone"`
+	Meta       map[string]string `json:"meta"`
+	Overlap    string            `json:"overlap"`
+	CreatedAt  time.Time         `json:"created_at"`
+	NextRun    time.Time         `json:"next_run"`
+	LastRun    *time.Time        `json:"last_run,omitempty"`
+	LastJobID  string            `json:"last_job_id,omitempty"`
+	// Queued are the runs waiting for the previous run to finish, when using
+	// the queue overlap policy
+	Queued int `json:"queued"`
+}
+
+// next returns the first time the schedule is due after t.
+func (s *Schedule) next(t time.Time) (time.Time, error) {
+	expr, err := cronexpr.Parse(s.Cron)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cron expression: %w", err)
+	}
+
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timezone: %w", err)
+	}
+
+	next := expr.Next(t.In(loc))
+	if next.IsZero() {
+		return time.Time{}, errors.New("cron expression is never due")
+	}
+
+	return next, nil
+}
+
+// scheduleStore keeps the schedules in a JSON file in the data dir.
+type scheduleStore struct {
+	mu        sync.Mutex
+	path      string
+	schedules map[string]*Schedule
+}
+
+func newScheduleStore(dataDir string) (*scheduleStore, error) {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating data dir: %w", err)
+	}
+
+	s := scheduleStore{
+		path:      filepath.Join(dataDir, "schedules.json"),
+		schedules: make(map[string]*Schedule),
+	}
+
+	sBytes, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading schedules: %w", err)
+	}
+
+	err = json.Unmarshal(sBytes, &s.schedules)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing schedules: %w", err)
+	}
+
+	return &s, nil
+}
+
+// save writes the schedules to a temporary file first, so a crash can't leave
+// a partially written file behind. Must be called with the lock held.
+func (s *scheduleStore) save() error {
+	sBytes, err := json.MarshalIndent(s.schedules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+
+	err = os.WriteFile(tmp, sBytes, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+func (s *scheduleStore) list(pipelineID string) []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedules := make([]Schedule, 0)
+	for _, sched := range s.schedules {
+		if len(pipelineID) == 0 || sched.PipelineID == pipelineID {
+			schedules = append(schedules, *sched)
+		}
+	}
+
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].CreatedAt.Before(schedules[j].CreatedAt) })
+
+	return schedules
+}
+
+func (s *scheduleStore) put(sched Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedules[sched.ID] = &sched
+
+	return s.save()
+}
+
+// update replaces a schedule, unless it has been deleted in the meantime.
+func (s *scheduleStore) update(sched Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[sched.ID]; !ok {
+		return nil
+	}
+
+	s.schedules[sched.ID] = &sched
+
+	return s.save()
+}
+
+func (s *scheduleStore) delete(pipelineID, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sched, ok := s.schedules[id]
+	if !ok || sched.PipelineID != pipelineID {
+		return false, nil
+	}
+
+	delete(s.schedules, id)
+
+	return true, s.save()
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type scheduleRequest struct {
+	Cron     string            `json:"cron"`
+	Timezone string            `json:"timezone"`
+	Meta     map[string]string `json:"meta"`
+	Overlap  string            `json:"overlap"`
+}
+
+func (ps *PipelineServer) createSchedule(c *gin.Context) {
+	pipelineID := c.Params.ByName("pipelineID")
+
+	var req scheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		httpErr := NewError(
+			WithCode(http.StatusBadRequest),
+			WithType(ErrorTypeInvalidRequest),
+			WithMessage("error parsing schedule"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	njob, httpErr := ps.getJob(pipelineID)
+	if httpErr != nil {
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	if !njob.full.IsParameterized() {
+		httpErr := NewError(
+			WithCode(http.StatusBadRequest),
+			WithType(ErrorTypeInvalidRequest),
+			WithMessage("only parameterized pipelines can be scheduled"),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	// Nomad only checks the meta on dispatch, which would fail on every run
+	if err := validateDispatchMeta(njob.full, req.Meta); err != nil {
+		httpErr := NewError(
+			WithCode(http.StatusBadRequest),
+			WithType(ErrorTypeInvalidRequest),
+			WithMessage("invalid schedule meta"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	if len(req.Timezone) == 0 {
+		req.Timezone = "UTC"
+	}
+
+	switch req.Overlap {
+	case "":
+		req.Overlap = OverlapSkip
+	case OverlapSkip, OverlapQueue, OverlapAllow:
+	default:
+		httpErr := NewError(
+			WithCode(http.StatusBadRequest),
+			WithType(ErrorTypeInvalidRequest),
+			WithMessage(fmt.Sprintf("invalid overlap policy (%v), must be one of: %v, %v, %v", req.Overlap, OverlapSkip, OverlapQueue, OverlapAllow)),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		httpErr := NewError(
+			WithType(ErrorTypeInternal),
+			WithMessage("error generating schedule id"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	now := time.Now()
+
+	sched := Schedule{
+		ID:         id,
+		PipelineID: pipelineID,
+		Cron:       req.Cron,
+		Timezone:   req.Timezone,
+		Meta:       req.Meta,
+		Overlap:    req.Overlap,
+		CreatedAt:  now,
+	}
+
+	sched.NextRun, err = sched.next(now)
+	if err != nil {
+		httpErr := NewError(
+			WithCode(http.StatusBadRequest),
+			WithType(ErrorTypeInvalidRequest),
+			WithMessage("invalid schedule"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	err = ps.schedules.put(sched)
+	if err != nil {
+		httpErr := NewError(
+			WithType(ErrorTypeInternal),
+			WithMessage("error saving schedule"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	ps.logger.Infow("created schedule", "pipeline", pipelineID, "schedule", sched.ID, "cron", sched.Cron, "next_run", sched.NextRun)
+
+	c.JSON(http.StatusCreated, sched)
+}
+
+func (ps *PipelineServer) listSchedules(c *gin.Context) {
+	pipelineID := c.Params.ByName("pipelineID")
+
+	c.JSON(http.StatusOK, ps.schedules.list(pipelineID))
+}
+
+func (ps *PipelineServer) deleteSchedule(c *gin.Context) {
+	pipelineID := c.Params.ByName("pipelineID")
+	scheduleID := c.Params.ByName("scheduleID")
+
+	deleted, err := ps.schedules.delete(pipelineID, scheduleID)
+	if err != nil {
+		httpErr := NewError(
+			WithType(ErrorTypeInternal),
+			WithMessage("error deleting schedule"),
+			WithError(err),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	if !deleted {
+		httpErr := NewError(
+			WithCode(http.StatusNotFound),
+			WithType(ErrorTypeNotFound),
+			WithMessage("schedule not found"),
+		)
+		httpErr.Apply(c, ps.logger)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RunSchedules dispatches the scheduled pipelines when they are due, until
+// the context is done.
+func (ps *PipelineServer) RunSchedules(ctx context.Context) error {
+	ps.logger.Info("starting pipeline schedules")
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			for _, sched := range ps.schedules.list("") {
+				ps.runSchedule(sched, now)
+			}
+		}
+	}
+}
+
+// runSchedule dispatches the pipeline if the schedule is due, or if a queued
+// run can start, taking into account the overlap policy.
+func (ps *PipelineServer) runSchedule(sched Schedule, now time.Time) {
+	due := !now.Before(sched.NextRun)
+	if !due && sched.Queued == 0 {
+		return
+	}
+
+	running, err := ps.jobRunning(sched.LastJobID)
+	if err != nil {
+		ps.logger.Errorw("error checking previous run of schedule", "schedule", sched.ID, "job", sched.LastJobID, "error", err)
+		return
+	}
+
+	dispatch := false
+	queued := false
+
+	dueRun := sched.NextRun
+
+	if due {
+		next, err := sched.next(now)
+		if err != nil {
+			ps.logger.Errorw("error getting next run of schedule", "schedule", sched.ID, "error", err)
+			return
+		}
+		sched.NextRun = next
+
+		switch {
+		case !running || sched.Overlap == OverlapAllow:
+			dispatch = true
+		case sched.Overlap == OverlapQueue:
+			ps.logger.Infow("previous run still running, queueing run", "schedule", sched.ID, "job", sched.LastJobID)
+			sched.Queued++
+		default:
+			ps.logger.Infow("previous run still running, skipping run", "schedule", sched.ID, "job", sched.LastJobID)
+		}
+	} else if !running {
+		dispatch = true
+		queued = true
+	}
+
+	if dispatch {
+		resp, _, err := ps.nomad.Jobs().Dispatch(sched.PipelineID, sched.Meta, nil, &nomad.WriteOptions{})
+		if err != nil {
+			ps.logger.Errorw("error dispatching scheduled pipeline", "schedule", sched.ID, "pipeline", sched.PipelineID, "error", err)
+
+			// a due run that failed to dispatch stays due, so it's tried
+			// again next time
+			if !queued {
+				sched.NextRun = dueRun
+			}
+		} else {
+			ps.logger.Infow("dispatched scheduled pipeline", "schedule", sched.ID, "pipeline", sched.PipelineID, "job", resp.DispatchedJobID)
+
+			lastRun := now
+			sched.LastRun = &lastRun
+			sched.LastJobID = resp.DispatchedJobID
+
+			// a queued run that failed to dispatch is tried again next time
+			if queued {
+				sched.Queued--
+			}
+		}
+	}
+
+	err = ps.schedules.update(sched)
+	if err != nil {
+		ps.logger.Errorw("error saving schedule", "schedule", sched.ID, "error", err)
+	}
+}
+
+// validateDispatchMeta checks the meta against the meta the parameterized job
+// requires and allows, the same way Nomad does when dispatching.
+func validateDispatchMeta(job *nomad.Job, meta map[string]string) error {
+	if job.ParameterizedJob == nil {
+		return nil
+	}
+
+	allowed := make(map[string]bool)
+	for _, k := range job.ParameterizedJob.MetaOptional {
+		allowed[k] = true
+	}
+
+	missing := make([]string, 0)
+	for _, k := range job.ParameterizedJob.MetaRequired {
+		allowed[k] = true
+		if _, ok := meta[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing required meta: %v", missing)
+	}
+
+	unexpected := make([]string, 0)
+	for k := range meta {
+		if !allowed[k] {
+			unexpected = append(unexpected, k)
+		}
+	}
+	if len(unexpected) > 0 {
+		sort.Strings(unexpected)
+		return fmt.Errorf("meta not allowed by the pipeline: %v", unexpected)
+	}
+
+	return nil
+}
+
+func (ps *PipelineServer) jobRunning(jobID string) (bool, error) {
+	if len(jobID) == 0 {
+		return false, nil
+	}
+
+	job, _, err := ps.nomad.Jobs().Info(jobID, &nomad.QueryOptions{})
+	if err != nil {
+		// the previous run was garbage collected
+		if nomadNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return job.Status != nil && *job.Status != "dead", nil
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"go.uber.org/zap"
+)
+
+func TestScheduleNext(t *testing.T) {
+	from := time.Date(2022, 3, 12, 15, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		cron     string
+		timezone string
+		want     time.Time
+		wantErr  bool
+	}{
+		{
+			name: "utc by default",
+			cron: "0 9 * * *",
+			want: time.Date(2022, 3, 13, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "timezone",
+			cron:     "0 9 * * *",
+			timezone: "Europe/London",
+			want:     time.Date(2022, 3, 13, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "daylight saving time",
+			cron:     "0 9 * * *",
+			timezone: "America/New_York",
+			want:     time.Date(2022, 3, 13, 13, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "every minute",
+			cron: "* * * * *",
+			want: from.Add(time.Minute),
+		},
+		{
+			name: "descriptor",
+			cron: "@hourly",
+			want: from.Add(time.Hour),
+		},
+		{
+			name:    "invalid cron",
+			cron:    "not a cron",
+			wantErr: true,
+		},
+		{
+			name:     "invalid timezone",
+			cron:     "0 9 * * *",
+			timezone: "Mars/Olympus_Mons",
+			wantErr:  true,
+		},
+		{
+			name:    "never due",
+			cron:    "0 0 1 1 * 2000",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Schedule{Cron: tt.cron, Timezone: tt.timezone}
+
+			got, err := s.next(from)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("next() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDispatchMeta(t *testing.T) {
+	job := &nomad.Job{
+		ParameterizedJob: &nomad.ParameterizedJobConfig{
+			MetaRequired: []string{"env"},
+			MetaOptional: []string{"version"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		meta    map[string]string
+		wantErr bool
+	}{
+		{name: "required", meta: map[string]string{"env": "prod"}},
+		{name: "required and optional", meta: map[string]string{"env": "prod", "version": "1.2.3"}},
+		{name: "missing required", meta: map[string]string{"version": "1.2.3"}, wantErr: true},
+		{name: "no meta", wantErr: true},
+		{name: "not allowed", meta: map[string]string{"env": "prod", "region": "eu"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDispatchMeta(job, tt.meta)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateDispatchMeta(%v) error = %v, wantErr %v", tt.meta, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunSchedule(t *testing.T) {
+	now := time.Date(2022, 3, 12, 15, 0, 0, 0, time.UTC)
+	due := now.Add(-time.Minute)
+	later := now.Add(time.Hour)
+
+	tests := []struct {
+		name          string
+		nextRun       time.Time
+		queued        int
+		dispatchFails bool
+		wantNextRun   time.Time
+		wantQueued    int
+		wantJobID     string
+	}{
+		{
+			name:        "due",
+			nextRun:     due,
+			wantNextRun: time.Date(2022, 3, 13, 9, 0, 0, 0, time.UTC),
+			wantJobID:   "example/dispatch-1",
+		},
+		{
+			name:          "due run fails to dispatch",
+			nextRun:       due,
+			dispatchFails: true,
+			wantNextRun:   due,
+		},
+		{
+			name:        "queued",
+			nextRun:     later,
+			queued:      2,
+			wantNextRun: later,
+			wantQueued:  1,
+			wantJobID:   "example/dispatch-1",
+		},
+		{
+			name:          "queued run fails to dispatch",
+			nextRun:       later,
+			queued:        2,
+			dispatchFails: true,
+			wantNextRun:   later,
+			wantQueued:    2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/job/example/dispatch" {
+					http.NotFound(w, r)
+					return
+				}
+				if tt.dispatchFails {
+					http.Error(w, "dispatch failed", http.StatusInternalServerError)
+					return
+				}
+				_ = json.NewEncoder(w).Encode(nomad.JobDispatchResponse{DispatchedJobID: "example/dispatch-1"})
+			}))
+			defer srv.Close()
+
+			nClient, err := nomad.NewClient(&nomad.Config{Address: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			schedules, err := newScheduleStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sched := Schedule{
+				ID:         "schedule",
+				PipelineID: "example",
+				Cron:       "0 9 * * *",
+				Timezone:   "UTC",
+				Overlap:    OverlapQueue,
+				NextRun:    tt.nextRun,
+				Queued:     tt.queued,
+			}
+			if err := schedules.put(sched); err != nil {
+				t.Fatal(err)
+			}
+
+			ps := PipelineServer{
+				nomad:     nClient,
+				logger:    zap.NewNop().Sugar(),
+				schedules: schedules,
+			}
+			ps.runSchedule(sched, now)
+
+			got := schedules.list("")[0]
+			if !got.NextRun.Equal(tt.wantNextRun) {
+				t.Errorf("NextRun = %v, want %v", got.NextRun, tt.wantNextRun)
+			}
+			if got.Queued != tt.wantQueued {
+				t.Errorf("Queued = %v, want %v", got.Queued, tt.wantQueued)
+			}
+			if got.LastJobID != tt.wantJobID {
+				t.Errorf("LastJobID = %q, want %q", got.LastJobID, tt.wantJobID)
+			}
+		})
+	}
+}
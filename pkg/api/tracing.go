@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+
+	"github.com/hyperbadger/nomad-pipeline/pkg/controller"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceRun records the spans of a finished run. The span of the run covers
+// the whole run, each group that ran gets a child span from when it was
+// triggered until it finished. The IDs of the spans are derived from the job,
+// the same as the ones passed to the tasks in TRACEPARENT.
+func traceRun(run *Run) {
+	tracer := otel.Tracer(controller.TracerName)
+
+	pipeline := run.pipeline()
+
+	traceID := controller.RunTraceID(run.ID, run.CreateIndex)
+
+	ctx := controller.WithSpanIDs(context.Background(), traceID, controller.RunSpanID(run.ID, run.CreateIndex))
+	ctx, runSpan := tracer.Start(ctx, pipeline,
+		trace.WithTimestamp(run.StartedAt),
+		trace.WithAttributes(
+			attribute.String("nomad.job_id", run.ID),
+			attribute.String("nomad_pipeline.pipeline", pipeline),
+			attribute.String("nomad_pipeline.status", run.Status),
+		),
+	)
+
+	for _, g := range run.TaskGroups {
+		if g.StartedAt == nil || g.FinishedAt == nil {
+			continue
+		}
+
+		start := *g.StartedAt
+		if g.TriggeredAt != nil && g.TriggeredAt.Before(start) {
+			start = *g.TriggeredAt
+		}
+
+		gCtx := controller.WithSpanIDs(ctx, traceID, controller.GroupSpanID(run.ID, run.CreateIndex, g.Name))
+		_, span := tracer.Start(gCtx, g.Name,
+			trace.WithTimestamp(start),
+			trace.WithAttributes(
+				attribute.String("nomad.group", g.Name),
+				attribute.String("nomad_pipeline.status", g.Status),
+				attribute.Int("nomad_pipeline.allocations", g.Allocations),
+				attribute.Float64("nomad_pipeline.queue_wait", g.QueueWait),
+			),
+		)
+		if g.Status != "success" {
+			span.SetStatus(codes.Error, g.Status)
+		}
+		span.End(trace.WithTimestamp(*g.FinishedAt))
+	}
+
+	if run.Status != "success" {
+		runSpan.SetStatus(codes.Error, run.Status)
+	}
+	runSpan.End(trace.WithTimestamp(*run.FinishedAt))
+}
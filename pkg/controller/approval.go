@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// ApprovalState returns the approval state of the group, empty if it isn't
+// gated or hasn't been triggered yet.
+func ApprovalState(tg *nomad.TaskGroup) string {
+	return lookupMetaTagStr(tg.Meta, TagApprovalState)
+}
+
+// parkForApproval keeps a group gated by the approval tag from being allocated
+// until it's approved, returns true if the group can't be triggered.
+func parkForApproval(tg *nomad.TaskGroup) bool {
+	approval, err := lookupMetaTagBool(tg.Meta, TagApproval)
+	if err != nil {
+		log.Warnf("error parsing approval, default to false: %v", err)
+	}
+	if !approval {
+		return false
+	}
+
+	switch ApprovalState(tg) {
+	case ApprovalApproved:
+		return false
+	case ApprovalRejected:
+		log.Warnf("group was rejected, not triggering it: %v", *tg.Name)
+	default:
+		log.Infof("group is waiting for approval: %v", *tg.Name)
+		tg.SetMeta(TagApprovalState, ApprovalPending)
+	}
+
+	return true
+}
+
+// AwaitingApproval returns the groups of the job waiting for approval.
+func AwaitingApproval(job *nomad.Job) []string {
+	return groupsInApprovalState(job, ApprovalPending)
+}
+
+// Rejected returns the groups of the job that were rejected.
+func Rejected(job *nomad.Job) []string {
+	return groupsInApprovalState(job, ApprovalRejected)
+}
+
+func groupsInApprovalState(job *nomad.Job, state string) []string {
+	groups := make([]string, 0)
+	for _, tg := range job.TaskGroups {
+		if ApprovalState(tg) == state {
+			groups = append(groups, *tg.Name)
+		}
+	}
+	return groups
+}
+
+func recordApproval(tg *nomad.TaskGroup, state string, approver string) {
+	tg.SetMeta(TagApprovalState, state)
+	tg.SetMeta(TagApprovalBy, approver)
+	tg.SetMeta(TagApprovalAt, time.Now().UTC().Format(time.RFC3339Nano))
+}
+
+// ApproveGroup records the approver and triggers the group waiting for
+// approval, the job needs to be updated for it to take effect.
+func ApproveGroup(tg *nomad.TaskGroup, approver string) {
+	recordApproval(tg, ApprovalApproved, approver)
+
+	// the time spent waiting for approval isn't part of the queue wait
+	tg.SetMeta(TagTriggeredAt, time.Now().UTC().Format(time.RFC3339Nano))
+	tg.Count = i2p(initialCount(tg))
+}
+
+// RejectGroup records the approver and cancels the group waiting for
+// approval, the groups after it never get triggered.
+func RejectGroup(tg *nomad.TaskGroup, approver string) {
+	recordApproval(tg, ApprovalRejected, approver)
+	tg.Count = i2p(0)
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParkForApproval(t *testing.T) {
+	tests := []struct {
+		name      string
+		meta      map[string]string
+		want      bool
+		wantState string
+	}{
+		{
+			name: "not gated",
+		},
+		{
+			name:      "gated",
+			meta:      map[string]string{TagApproval: "true"},
+			want:      true,
+			wantState: ApprovalPending,
+		},
+		{
+			name:      "still pending",
+			meta:      map[string]string{TagApproval: "true", TagApprovalState: ApprovalPending},
+			want:      true,
+			wantState: ApprovalPending,
+		},
+		{
+			name:      "approved",
+			meta:      map[string]string{TagApproval: "true", TagApprovalState: ApprovalApproved},
+			wantState: ApprovalApproved,
+		},
+		{
+			name:      "rejected",
+			meta:      map[string]string{TagApproval: "true", TagApprovalState: ApprovalRejected},
+			want:      true,
+			wantState: ApprovalRejected,
+		},
+		{
+			name: "invalid approval",
+			meta: map[string]string{TagApproval: "maybe"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := testGroup("deploy", 0, tt.meta)
+
+			if got := parkForApproval(tg); got != tt.want {
+				t.Errorf("parkForApproval() = %v, want %v", got, tt.want)
+			}
+			if got := ApprovalState(tg); got != tt.wantState {
+				t.Errorf("ApprovalState() = %q, want %q", got, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestApproveAndRejectGroup(t *testing.T) {
+	job := testJob(nil,
+		testGroup("deploy-staging", 0, map[string]string{TagApproval: "true", TagCount: "3", TagParallelism: "2"}),
+		testGroup("deploy-prod", 0, map[string]string{TagApproval: "true"}),
+		testGroup("cleanup", 0, nil),
+	)
+	staging := job.LookupTaskGroup("deploy-staging")
+	prod := job.LookupTaskGroup("deploy-prod")
+
+	parkForApproval(staging)
+	parkForApproval(prod)
+
+	if got, want := AwaitingApproval(job), []string{"deploy-staging", "deploy-prod"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("AwaitingApproval() = %v, want %v", got, want)
+	}
+
+	ApproveGroup(staging, "jane")
+	RejectGroup(prod, "john")
+
+	if got := *staging.Count; got != 2 {
+		t.Errorf("approved group count = %v, want the first batch of 2", got)
+	}
+	if got := staging.Meta[TagApprovalBy]; got != "jane" {
+		t.Errorf("approved group approver = %q, want %q", got, "jane")
+	}
+	if _, ok := staging.Meta[TagTriggeredAt]; !ok {
+		t.Errorf("approved group has no triggered at time")
+	}
+	if parkForApproval(staging) {
+		t.Errorf("parkForApproval() parked an approved group")
+	}
+
+	if got := *prod.Count; got != 0 {
+		t.Errorf("rejected group count = %v, want 0", got)
+	}
+	if got := prod.Meta[TagApprovalBy]; got != "john" {
+		t.Errorf("rejected group approver = %q, want %q", got, "john")
+	}
+
+	if got := AwaitingApproval(job); len(got) != 0 {
+		t.Errorf("AwaitingApproval() = %v, want none", got)
+	}
+	if got, want := Rejected(job), []string{"deploy-prod"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Rejected() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,484 @@
+package controller
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ArtifactStoreLocal = "local"
+	ArtifactStoreS3    = "s3"
+
+	// name of the volume added to task groups when using a local store
+	artifactsVolume = "nomad-pipeline-artifacts"
+)
+
+var ErrArtifactNotFound = errors.New("artifact not found")
+
+// ArtifactStore keeps the files handed off between task groups.
+type ArtifactStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+func NewArtifactStore(c ArtifactsConfig) (ArtifactStore, error) {
+	switch c.Store {
+	case ArtifactStoreLocal:
+		return &LocalArtifactStore{Path: c.Local.Path}, nil
+	case ArtifactStoreS3:
+		s := S3ArtifactStore{
+			Config: c.S3,
+			client: &http.Client{Timeout: 10 * time.Minute},
+		}
+		return &s, nil
+	case "":
+		return nil, errors.New("no artifact store configured")
+	default:
+		return nil, fmt.Errorf("unknown artifact store: %v", c.Store)
+	}
+}
+
+// LocalArtifactStore keeps artifacts in a directory, usually a host volume
+// shared by the clients.
+type LocalArtifactStore struct {
+	Path string
+}
+
+func (s *LocalArtifactStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	p := filepath.Join(s.Path, filepath.FromSlash(key))
+
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (s *LocalArtifactStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.Path, filepath.FromSlash(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrArtifactNotFound
+	}
+	return f, err
+}
+
+// S3ArtifactStore keeps artifacts in a bucket of an S3 compatible endpoint
+// (eg. MinIO), using path style requests signed with AWS signature v4.
+type S3ArtifactStore struct {
+	Config S3Config
+
+	client *http.Client
+}
+
+func (s *S3ArtifactStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	resp, err := s.do(ctx, http.MethodPut, key, r, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (s *S3ArtifactStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s *S3ArtifactStore) do(ctx context.Context, method string, key string, body io.Reader, size int64) (*http.Response, error) {
+	uri := "/" + s3Escape(s.Config.Bucket) + "/" + s3Escape(key)
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(s.Config.Endpoint, "/")+uri, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	s.sign(req, uri, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrArtifactNotFound
+	}
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response code from s3: %d (%s)", resp.StatusCode, msg)
+	}
+
+	return resp, nil
+}
+
+// sign adds an AWS signature v4 to the request, the payload isn't signed so
+// it can be streamed.
+func (s *S3ArtifactStore) sign(req *http.Request, uri string, t time.Time) {
+	const payload = "UNSIGNED-PAYLOAD"
+
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payload,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := date + "/" + s.Config.Region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.Config.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.Config.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes everything but unreserved characters and slashes, as
+// expected in the canonical URI of a signed request.
+func s3Escape(p string) string {
+	var sb strings.Builder
+	for _, b := range []byte(p) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/':
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+// addArtifactsVolume adds the host volume of the local artifact store to the
+// task group, nothing is needed for other stores.
+func (pc *PipelineController) addArtifactsVolume(tg *nomad.TaskGroup) error {
+	c := pc.Config.Artifacts
+	if c.Store != ArtifactStoreLocal || len(c.Local.Volume) == 0 {
+		return nil
+	}
+
+	if tg.Volumes == nil {
+		tg.Volumes = make(map[string]*nomad.VolumeRequest)
+	}
+
+	if v, ok := tg.Volumes[artifactsVolume]; ok && v.Source != c.Local.Volume {
+		return fmt.Errorf("volume (%v) already exists with a different source: %v", artifactsVolume, v.Source)
+	}
+
+	tg.Volumes[artifactsVolume] = &nomad.VolumeRequest{
+		Name:   artifactsVolume,
+		Type:   "host",
+		Source: c.Local.Volume,
+	}
+
+	return nil
+}
+
+func (pc *PipelineController) mountArtifactsVolume(tg *nomad.TaskGroup, task *nomad.Task) {
+	if _, ok := tg.Volumes[artifactsVolume]; !ok {
+		return
+	}
+
+	volume := artifactsVolume
+	destination := pc.Config.Artifacts.Local.Path
+
+	task.VolumeMounts = append(task.VolumeMounts, &nomad.VolumeMount{
+		Volume:      &volume,
+		Destination: &destination,
+	})
+}
+
+// artifactsManifest lists the files uploaded by a group, so the downstream
+// groups know what to download without listing the store.
+type artifactsManifest struct {
+	Files []string `json:"files"`
+}
+
+// artifactsPrefix is where an allocation of a group keeps its artifacts, every
+// allocation gets its own prefix so they don't overwrite each other.
+func artifactsPrefix(jobID, group string, index int) string {
+	return path.Join(jobID, group, strconv.Itoa(index))
+}
+
+// allocIndex returns the index of the current allocation within its group.
+func allocIndex() (int, error) {
+	index := os.Getenv("NOMAD_ALLOC_INDEX")
+	if len(index) == 0 {
+		return 0, nil
+	}
+
+	return strconv.Atoi(index)
+}
+
+// artifactPath returns where a file of the manifest goes in the alloc dir, or
+// an error if it would end up outside of it.
+func artifactPath(allocDir, file string) (string, error) {
+	clean := path.Clean(file)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("artifact path escapes the alloc dir: %v", file)
+	}
+
+	return filepath.Join(allocDir, filepath.FromSlash(clean)), nil
+}
+
+// UploadArtifacts uploads the files matching the comma separated globs,
+// relative to NOMAD_ALLOC_DIR. Matching directories are uploaded recursively.
+func (pc *PipelineController) UploadArtifacts(ctx context.Context, artifacts string) error {
+	store, err := NewArtifactStore(pc.Config.Artifacts)
+	if err != nil {
+		return err
+	}
+
+	allocDir := os.Getenv("NOMAD_ALLOC_DIR")
+
+	files := make([]string, 0)
+	for _, glob := range split(artifacts) {
+		matches, err := filepath.Glob(filepath.Join(allocDir, glob))
+		if err != nil {
+			return fmt.Errorf("error finding artifacts using provided glob (%v): %w", glob, err)
+		}
+		if len(matches) == 0 {
+			log.Warnf("no artifacts found for glob: %v", glob)
+		}
+
+		for _, match := range matches {
+			err = filepath.WalkDir(match, func(p string, d os.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+
+				rel, err := filepath.Rel(allocDir, p)
+				if err != nil {
+					return err
+				}
+
+				files = append(files, filepath.ToSlash(rel))
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("error finding artifacts in (%v): %w", match, err)
+			}
+		}
+	}
+
+	files = dedupStr(files)
+
+	index, err := allocIndex()
+	if err != nil {
+		return fmt.Errorf("error parsing alloc index: %w", err)
+	}
+
+	prefix := artifactsPrefix(pc.JobID, pc.GroupName, index)
+
+	for _, file := range files {
+		log.Infof("uploading artifact: %v", file)
+
+		err = putFile(ctx, store, path.Join(prefix, "files", file), filepath.Join(allocDir, filepath.FromSlash(file)))
+		if err != nil {
+			return fmt.Errorf("error uploading artifact (%v): %w", file, err)
+		}
+	}
+
+	manifest, err := json.Marshal(artifactsManifest{Files: files})
+	if err != nil {
+		return err
+	}
+
+	err = store.Put(ctx, path.Join(prefix, "manifest.json"), strings.NewReader(string(manifest)), int64(len(manifest)))
+	if err != nil {
+		return fmt.Errorf("error uploading artifacts manifest: %w", err)
+	}
+
+	return nil
+}
+
+func putFile(ctx context.Context, store ArtifactStore, key string, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, key, f, fi.Size())
+}
+
+// DownloadInputs downloads artifacts of upstream groups into NOMAD_ALLOC_DIR.
+// Inputs are comma separated, either a group name for all of its artifacts
+// or <group>:<glob> for only the matching ones. The artifacts of every
+// allocation of the group are downloaded, in order of their index.
+func (pc *PipelineController) DownloadInputs(ctx context.Context, inputs string) error {
+	store, err := NewArtifactStore(pc.Config.Artifacts)
+	if err != nil {
+		return err
+	}
+
+	allocDir := os.Getenv("NOMAD_ALLOC_DIR")
+
+	for _, input := range split(inputs) {
+		group, glob, _ := strings.Cut(input, ":")
+
+		tg := pc.Job.LookupTaskGroup(group)
+		if tg == nil {
+			return fmt.Errorf("input group not found in job: %v", group)
+		}
+
+		found := false
+		for index := 0; index < groupTotalCount(tg); index++ {
+			prefix := artifactsPrefix(pc.JobID, group, index)
+
+			manifest, err := getManifest(ctx, store, prefix)
+			if errors.Is(err, ErrArtifactNotFound) {
+				log.Warnf("no artifacts uploaded by allocation (%v) of group (%v)", index, group)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("error getting artifacts manifest of group (%v): %w", group, err)
+			}
+
+			found = true
+
+			for _, file := range manifest.Files {
+				if len(glob) > 0 && !matchArtifact(glob, file) {
+					continue
+				}
+
+				dest, err := artifactPath(allocDir, file)
+				if err != nil {
+					return fmt.Errorf("invalid artifact of group (%v): %w", group, err)
+				}
+
+				// the outputs file of the group is its own, not the one of
+				// the upstream group
+				if path.Clean(file) == OutputsFile {
+					continue
+				}
+
+				log.Infof("downloading artifact of group (%v): %v", group, file)
+
+				err = getFile(ctx, store, path.Join(prefix, "files", path.Clean(file)), dest)
+				if err != nil {
+					return fmt.Errorf("error downloading artifact (%v) of group (%v): %w", file, group, err)
+				}
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("error getting artifacts manifest of group (%v): %w", group, ErrArtifactNotFound)
+		}
+	}
+
+	return nil
+}
+
+func getManifest(ctx context.Context, store ArtifactStore, prefix string) (*artifactsManifest, error) {
+	r, err := store.Get(ctx, path.Join(prefix, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var manifest artifactsManifest
+	err = json.NewDecoder(r).Decode(&manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// matchArtifact matches the file against the glob, or any of its parent
+// directories, the same way uploads walk matching directories.
+func matchArtifact(glob, file string) bool {
+	for p := file; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(glob, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func getFile(ctx context.Context, store ArtifactStore, key string, p string) error {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
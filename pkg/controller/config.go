@@ -0,0 +1,548 @@
+package controller
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Config is shared by the agent and server commands. It is read from a yaml
+// file (see the --config flag), after which environment variables take
+// precedence over values in the file.
+type Config struct {
+	// Nomad sets how to connect to Nomad
+	Nomad NomadConfig `yaml:"nomad"`
+
+	// Hooks sets how the injected wait and next tasks are run
+	Hooks HooksConfig `yaml:"hooks"`
+
+	// Defaults are used for task groups that don't set the equivalent tag
+	Defaults DefaultsConfig `yaml:"defaults"`
+
+	// Retry sets how failed Nomad event stream subscriptions are retried
+	Retry RetryConfig `yaml:"retry"`
+
+	// Artifacts sets where files handed off between task groups are kept
+	Artifacts ArtifactsConfig `yaml:"artifacts"`
+
+	// Tracing sets where spans of pipeline runs are exported to
+	Tracing TracingConfig `yaml:"tracing"`
+
+	// Metrics sets where agent hooks send their metrics
+	Metrics MetricsConfig `yaml:"metrics"`
+
+	// Server configures the pipeline server
+	Server ServerConfig `yaml:"server"`
+
+	// Notifications are sinks that get notified about pipeline runs
+	Notifications []NotificationConfig `yaml:"notifications"`
+}
+
+type NomadConfig struct {
+	Address   string         `yaml:"address"`
+	Namespace string         `yaml:"namespace"`
+	Region    string         `yaml:"region"`
+	Token     string         `yaml:"token"`
+	TLS       NomadTLSConfig `yaml:"tls"`
+}
+
+type NomadTLSConfig struct {
+	CACert     string `yaml:"ca_cert"`
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+	Insecure   bool   `yaml:"insecure"`
+}
+
+type DefaultsConfig struct {
+	WaitTimeout      time.Duration `yaml:"wait_timeout"`
+	DependencyPolicy string        `yaml:"dependency_policy"`
+}
+
+type RetryConfig struct {
+	MaxRetries int           `yaml:"max_retries"`
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+type ArtifactsConfig struct {
+	Store string              `yaml:"store"`
+	Local LocalArtifactConfig `yaml:"local"`
+	S3    S3Config            `yaml:"s3"`
+}
+
+type LocalArtifactConfig struct {
+	Path string `yaml:"path"`
+	// Volume is a host volume mounted at Path into the hooks
+	Volume string `yaml:"volume"`
+}
+
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint"`
+	Bucket          string `yaml:"bucket"`
+	Region          string `yaml:"region"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+}
+
+type TracingConfig struct {
+	// Endpoint is the host:port of an OTLP/HTTP collector, tracing is
+	// disabled when empty
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+}
+
+func (c TracingConfig) Enabled() bool {
+	return len(c.Endpoint) > 0
+}
+
+type MetricsConfig struct {
+	// PushGateway is the url of a Prometheus push gateway
+	PushGateway string `yaml:"push_gateway"`
+	// TextfileDir is a directory read by the textfile collector of the node
+	// exporter
+	TextfileDir string `yaml:"textfile_dir"`
+}
+
+type ServerConfig struct {
+	Addr      string              `yaml:"addr"`
+	Scheduler bool                `yaml:"scheduler"`
+	DataDir   string              `yaml:"data_dir"`
+	History   ServerHistoryConfig `yaml:"history"`
+	Webhooks  []WebhookConfig     `yaml:"webhooks"`
+	Auth      ServerAuthConfig    `yaml:"auth"`
+	TLS       ServerTLSConfig     `yaml:"tls"`
+}
+
+type ServerHistoryConfig struct {
+	// Retention is how long finished runs are kept, forever when zero
+	Retention time.Duration `yaml:"retention"`
+	// MaxRuns is how many finished runs are kept, unlimited when zero
+	MaxRuns int `yaml:"max_runs"`
+}
+
+// formats of inbound webhooks
+const (
+	WebhookTypeGeneric = "generic"
+	WebhookTypeGitHub  = "github"
+	WebhookTypeGitLab  = "gitlab"
+)
+
+// WebhookConfig lets a pipeline be dispatched by an inbound webhook, see the
+// /hooks/:pipelineID endpoint of the server.
+type WebhookConfig struct {
+	Pipeline string `yaml:"pipeline"`
+	Type     string `yaml:"type"`
+	// Secret checks the signature of the payload, or the token for GitLab
+	Secret string `yaml:"secret"`
+	// Meta maps dispatch meta to JSONPath expressions into the payload
+	Meta map[string]string `yaml:"meta"`
+}
+
+type ServerAuthConfig struct {
+	// Tokens accepted as bearer tokens, auth is disabled when empty
+	Tokens []string `yaml:"tokens"`
+}
+
+type ServerTLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+func (c ServerTLSConfig) Enabled() bool {
+	return len(c.CertFile) > 0
+}
+
+const (
+	NotificationTypeWebhook = "webhook"
+)
+
+// events notifications can be sent for
+const (
+	NotificationEventRunStarted   = "run.started"
+	NotificationEventRunCompleted = "run.completed"
+	NotificationEventRunCancelled = "run.cancelled"
+	NotificationEventGroupFailed  = "group.failed"
+)
+
+var notificationEvents = map[string]bool{
+	NotificationEventRunStarted:   true,
+	NotificationEventRunCompleted: true,
+	NotificationEventRunCancelled: true,
+	NotificationEventGroupFailed:  true,
+}
+
+type NotificationConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	URL  string `yaml:"url"`
+	// Events to notify about, all events when empty
+	Events []string `yaml:"events"`
+	// Secret signs the payload, unsigned when empty
+	Secret string `yaml:"secret"`
+}
+
+// Wants checks if the notification is sent for the event.
+func (n NotificationConfig) Wants(event string) bool {
+	if len(n.Events) == 0 {
+		return true
+	}
+
+	for _, e := range n.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+func DefaultConfig() *Config {
+	c := Config{
+		Defaults: DefaultsConfig{
+			DependencyPolicy: DependencyPolicyFail,
+		},
+		Artifacts: ArtifactsConfig{
+			S3: S3Config{
+				Region: "us-east-1",
+			},
+		},
+		Retry: RetryConfig{
+			MaxRetries: 10,
+			MinBackoff: time.Second,
+			MaxBackoff: time.Minute,
+		},
+		Server: ServerConfig{
+			Addr:    "127.0.0.1:4656",
+			DataDir: "data",
+			History: ServerHistoryConfig{
+				Retention: 30 * 24 * time.Hour,
+			},
+		},
+	}
+
+	return &c
+}
+
+// LoadConfig reads the config at cPath on top of the defaults, applies any
+// environment variable overrides and validates the result. A missing config
+// file is not an error.
+func LoadConfig(cPath string) (*Config, error) {
+	c := DefaultConfig()
+
+	cBytes, err := os.ReadFile(cPath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Debugf("config file doesn't exist, using defaults (path: %v)", cPath)
+	} else if err != nil {
+		return nil, fmt.Errorf("error loading config (path: %v): %w", cPath, err)
+	} else {
+		err = yaml.Unmarshal(cBytes, c)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config yaml: %w", err)
+		}
+	}
+
+	err = c.applyEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error applying environment variables to config: %w", err)
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return c, nil
+}
+
+// applyEnv overrides the config with environment variables. The Nomad
+// connection uses the same variables as the Nomad CLI, everything else is
+// prefixed with NOMAD_PIPELINE_.
+func (c *Config) applyEnv() error {
+	strs := map[string]*string{
+		"NOMAD_ADDR":        &c.Nomad.Address,
+		"NOMAD_NAMESPACE":   &c.Nomad.Namespace,
+		"NOMAD_REGION":      &c.Nomad.Region,
+		"NOMAD_TOKEN":       &c.Nomad.Token,
+		"NOMAD_CACERT":      &c.Nomad.TLS.CACert,
+		"NOMAD_CLIENT_CERT": &c.Nomad.TLS.ClientCert,
+		"NOMAD_CLIENT_KEY":  &c.Nomad.TLS.ClientKey,
+
+		"NOMAD_PIPELINE_HOOKS_DRIVER":                   &c.Hooks.Driver,
+		"NOMAD_PIPELINE_HOOKS_IMAGE":                    &c.Hooks.Image,
+		"NOMAD_PIPELINE_HOOKS_COMMAND":                  &c.Hooks.Command,
+		"NOMAD_PIPELINE_HOOKS_RESTART_MODE":             &c.Hooks.Restart.Mode,
+		"NOMAD_PIPELINE_DEFAULTS_DEPENDENCY_POLICY":     &c.Defaults.DependencyPolicy,
+		"NOMAD_PIPELINE_ARTIFACTS_STORE":                &c.Artifacts.Store,
+		"NOMAD_PIPELINE_ARTIFACTS_LOCAL_PATH":           &c.Artifacts.Local.Path,
+		"NOMAD_PIPELINE_ARTIFACTS_LOCAL_VOLUME":         &c.Artifacts.Local.Volume,
+		"NOMAD_PIPELINE_ARTIFACTS_S3_ENDPOINT":          &c.Artifacts.S3.Endpoint,
+		"NOMAD_PIPELINE_ARTIFACTS_S3_BUCKET":            &c.Artifacts.S3.Bucket,
+		"NOMAD_PIPELINE_ARTIFACTS_S3_REGION":            &c.Artifacts.S3.Region,
+		"NOMAD_PIPELINE_ARTIFACTS_S3_ACCESS_KEY_ID":     &c.Artifacts.S3.AccessKeyID,
+		"NOMAD_PIPELINE_ARTIFACTS_S3_SECRET_ACCESS_KEY": &c.Artifacts.S3.SecretAccessKey,
+		"NOMAD_PIPELINE_TRACING_ENDPOINT":               &c.Tracing.Endpoint,
+		"NOMAD_PIPELINE_METRICS_PUSH_GATEWAY":           &c.Metrics.PushGateway,
+		"NOMAD_PIPELINE_METRICS_TEXTFILE_DIR":           &c.Metrics.TextfileDir,
+		"NOMAD_PIPELINE_SERVER_ADDR":                    &c.Server.Addr,
+		"NOMAD_PIPELINE_SERVER_DATA_DIR":                &c.Server.DataDir,
+		"NOMAD_PIPELINE_SERVER_TLS_CERT_FILE":           &c.Server.TLS.CertFile,
+		"NOMAD_PIPELINE_SERVER_TLS_KEY_FILE":            &c.Server.TLS.KeyFile,
+	}
+
+	for env, value := range strs {
+		if v, ok := os.LookupEnv(env); ok {
+			*value = v
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"NOMAD_PIPELINE_DEFAULTS_WAIT_TIMEOUT":    &c.Defaults.WaitTimeout,
+		"NOMAD_PIPELINE_HOOKS_KILL_TIMEOUT":       &c.Hooks.KillTimeout,
+		"NOMAD_PIPELINE_HOOKS_RESTART_DELAY":      &c.Hooks.Restart.Delay,
+		"NOMAD_PIPELINE_HOOKS_RESTART_INTERVAL":   &c.Hooks.Restart.Interval,
+		"NOMAD_PIPELINE_RETRY_MIN_BACKOFF":        &c.Retry.MinBackoff,
+		"NOMAD_PIPELINE_RETRY_MAX_BACKOFF":        &c.Retry.MaxBackoff,
+		"NOMAD_PIPELINE_SERVER_HISTORY_RETENTION": &c.Server.History.Retention,
+	}
+
+	for env, value := range durations {
+		if v, ok := os.LookupEnv(env); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("can't convert env var (%v) of value (%v) to a duration", env, v)
+			}
+			*value = d
+		}
+	}
+
+	ints := map[string]*int{
+		"NOMAD_PIPELINE_HOOKS_CPU":                   &c.Hooks.CPU,
+		"NOMAD_PIPELINE_HOOKS_MEMORY_MB":             &c.Hooks.MemoryMB,
+		"NOMAD_PIPELINE_HOOKS_MEMORY_MAX_MB":         &c.Hooks.MemoryMaxMB,
+		"NOMAD_PIPELINE_HOOKS_LOGS_MAX_FILES":        &c.Hooks.Logs.MaxFiles,
+		"NOMAD_PIPELINE_HOOKS_LOGS_MAX_FILE_SIZE_MB": &c.Hooks.Logs.MaxFileSizeMB,
+		"NOMAD_PIPELINE_RETRY_MAX_RETRIES":           &c.Retry.MaxRetries,
+		"NOMAD_PIPELINE_SERVER_HISTORY_MAX_RUNS":     &c.Server.History.MaxRuns,
+	}
+
+	for env, value := range ints {
+		if v, ok := os.LookupEnv(env); ok {
+			var err error
+			*value, err = strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("can't convert env var (%v) of value (%v) to an int", env, v)
+			}
+		}
+	}
+
+	// unset attempts are left for Nomad to default, zero disables restarts
+	if v, ok := os.LookupEnv("NOMAD_PIPELINE_HOOKS_RESTART_ATTEMPTS"); ok {
+		attempts, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("can't convert env var (%v) of value (%v) to an int", "NOMAD_PIPELINE_HOOKS_RESTART_ATTEMPTS", v)
+		}
+		c.Hooks.Restart.Attempts = &attempts
+	}
+
+	bools := map[string]*bool{
+		"NOMAD_SKIP_VERIFY":               &c.Nomad.TLS.Insecure,
+		"NOMAD_PIPELINE_SERVER_SCHEDULER": &c.Server.Scheduler,
+		"NOMAD_PIPELINE_TRACING_INSECURE": &c.Tracing.Insecure,
+	}
+
+	for env, value := range bools {
+		if v, ok := os.LookupEnv(env); ok {
+			var err error
+			*value, err = strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("can't convert env var (%v) of value (%v) to a bool", env, v)
+			}
+		}
+	}
+
+	if v, ok := os.LookupEnv("NOMAD_PIPELINE_SERVER_AUTH_TOKENS"); ok {
+		c.Server.Auth.Tokens = split(v)
+	}
+
+	// secrets of the webhooks are set by their index, so they can be kept out
+	// of the config file
+	for i := range c.Server.Webhooks {
+		if v, ok := os.LookupEnv(fmt.Sprintf("NOMAD_PIPELINE_SERVER_WEBHOOKS_%d_SECRET", i)); ok {
+			c.Server.Webhooks[i].Secret = v
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if c.Hooks.CPU < 0 || c.Hooks.MemoryMB < 0 || c.Hooks.MemoryMaxMB < 0 {
+		return errors.New("hooks resources can't be negative")
+	}
+
+	if c.Hooks.MemoryMaxMB > 0 && c.Hooks.MemoryMaxMB < c.Hooks.MemoryMB {
+		return errors.New("hooks memory_max_mb must be greater than memory_mb")
+	}
+
+	if len(c.Defaults.DependencyPolicy) > 0 && !validDependencyPolicy(c.Defaults.DependencyPolicy) {
+		return fmt.Errorf("invalid default dependency policy: %v", c.Defaults.DependencyPolicy)
+	}
+
+	if c.Defaults.WaitTimeout < 0 {
+		return errors.New("default wait timeout can't be negative")
+	}
+
+	if c.Retry.MaxRetries < 0 {
+		return errors.New("retry max_retries can't be negative")
+	}
+
+	if c.Retry.MinBackoff <= 0 || c.Retry.MaxBackoff < c.Retry.MinBackoff {
+		return errors.New("retry min_backoff must be positive and not greater than max_backoff")
+	}
+
+	switch c.Artifacts.Store {
+	case "":
+	case ArtifactStoreLocal:
+		if len(c.Artifacts.Local.Path) == 0 {
+			return errors.New("artifacts local path must be set when using the local store")
+		}
+	case ArtifactStoreS3:
+		if len(c.Artifacts.S3.Endpoint) == 0 || len(c.Artifacts.S3.Bucket) == 0 {
+			return errors.New("artifacts s3 endpoint and bucket must be set when using the s3 store")
+		}
+	default:
+		return fmt.Errorf("unknown artifacts store: %v", c.Artifacts.Store)
+	}
+
+	if len(c.Server.Addr) == 0 {
+		return errors.New("server addr must be set")
+	}
+
+	if c.Server.History.Retention < 0 || c.Server.History.MaxRuns < 0 {
+		return errors.New("server history retention and max_runs can't be negative")
+	}
+
+	if (len(c.Server.TLS.CertFile) > 0) != (len(c.Server.TLS.KeyFile) > 0) {
+		return errors.New("server tls cert_file and key_file must be set together")
+	}
+
+	pipelines := make(map[string]bool)
+	for i, w := range c.Server.Webhooks {
+		if len(w.Pipeline) == 0 {
+			return fmt.Errorf("server webhook (%v) must have a pipeline", i)
+		}
+		if pipelines[w.Pipeline] {
+			return fmt.Errorf("server webhook (%v) has a pipeline with another webhook: %v", i, w.Pipeline)
+		}
+		pipelines[w.Pipeline] = true
+
+		switch w.Type {
+		case "", WebhookTypeGeneric, WebhookTypeGitHub, WebhookTypeGitLab:
+		default:
+			return fmt.Errorf("server webhook (%v) has unsupported type: %v", i, w.Type)
+		}
+
+		if len(w.Secret) == 0 {
+			return fmt.Errorf("server webhook (%v) must have a secret", i)
+		}
+	}
+
+	for i, n := range c.Notifications {
+		if n.Type != NotificationTypeWebhook {
+			return fmt.Errorf("notification (%v) has unsupported type: %v", i, n.Type)
+		}
+		if len(n.URL) == 0 {
+			return fmt.Errorf("notification (%v) must have an url", i)
+		}
+		for _, e := range n.Events {
+			if !notificationEvents[e] {
+				return fmt.Errorf("notification (%v) has unknown event: %v", i, e)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of the config with secrets hidden, safe for
+// printing.
+func (c Config) Redacted() Config {
+	redact := func(s string) string {
+		if len(s) == 0 {
+			return s
+		}
+		return "<redacted>"
+	}
+
+	c.Nomad.Token = redact(c.Nomad.Token)
+	c.Artifacts.S3.AccessKeyID = redact(c.Artifacts.S3.AccessKeyID)
+	c.Artifacts.S3.SecretAccessKey = redact(c.Artifacts.S3.SecretAccessKey)
+
+	tokens := make([]string, len(c.Server.Auth.Tokens))
+	for i, t := range c.Server.Auth.Tokens {
+		tokens[i] = redact(t)
+	}
+	c.Server.Auth.Tokens = tokens
+
+	webhooks := make([]WebhookConfig, len(c.Server.Webhooks))
+	for i, w := range c.Server.Webhooks {
+		w.Secret = redact(w.Secret)
+		webhooks[i] = w
+	}
+	c.Server.Webhooks = webhooks
+
+	notifications := make([]NotificationConfig, len(c.Notifications))
+	for i, n := range c.Notifications {
+		n.Secret = redact(n.Secret)
+		notifications[i] = n
+	}
+	c.Notifications = notifications
+
+	return c
+}
+
+// NewClient creates a Nomad client using the connection config, anything not
+// set falls back to the Nomad defaults.
+func (nc NomadConfig) NewClient() (*nomad.Client, error) {
+	tlsConfig := &nomad.TLSConfig{
+		CACert:     nc.TLS.CACert,
+		ClientCert: nc.TLS.ClientCert,
+		ClientKey:  nc.TLS.ClientKey,
+		Insecure:   nc.TLS.Insecure,
+	}
+
+	// same as the default client of the Nomad api, with requests going
+	// through the metrics transport
+	httpClient := cleanhttp.DefaultPooledClient()
+	transport := httpClient.Transport.(*http.Transport)
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	transport.ForceAttemptHTTP2 = false
+
+	err := nomad.ConfigureTLS(httpClient, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient.Transport = metricsTransport{next: transport}
+
+	return nomad.NewClient(&nomad.Config{
+		Address:    nc.Address,
+		Namespace:  nc.Namespace,
+		Region:     nc.Region,
+		SecretID:   nc.Token,
+		TLSConfig:  tlsConfig,
+		HttpClient: httpClient,
+	})
+}
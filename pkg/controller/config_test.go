@@ -0,0 +1,64 @@
+package controller
+
+import "testing"
+
+func TestLoadExampleConfig(t *testing.T) {
+	c, err := LoadConfig("../../examples/config.yaml")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	if len(c.Server.Webhooks) == 0 {
+		t.Fatal("example config has no webhooks")
+	}
+}
+
+func TestWebhookSecretEnv(t *testing.T) {
+	t.Setenv("NOMAD_PIPELINE_SERVER_WEBHOOKS_0_SECRET", "from-env")
+
+	c, err := LoadConfig("../../examples/config.yaml")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	if got := c.Server.Webhooks[0].Secret; got != "from-env" {
+		t.Errorf("webhook secret = %q, want %q", got, "from-env")
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := DefaultConfig()
+	c.Nomad.Token = "nomad-token"
+	c.Artifacts.S3.Bucket = "artifacts"
+	c.Artifacts.S3.AccessKeyID = "AKIAEXAMPLE"
+	c.Artifacts.S3.SecretAccessKey = "secret-key"
+	c.Server.Auth.Tokens = []string{"api-token"}
+	c.Server.Webhooks = []WebhookConfig{{Secret: "webhook-secret"}}
+	c.Notifications = []NotificationConfig{{Secret: "notification-secret"}}
+
+	r := c.Redacted()
+
+	secrets := map[string]string{
+		"nomad token":          r.Nomad.Token,
+		"s3 access key id":     r.Artifacts.S3.AccessKeyID,
+		"s3 secret access key": r.Artifacts.S3.SecretAccessKey,
+		"auth token":           r.Server.Auth.Tokens[0],
+		"webhook secret":       r.Server.Webhooks[0].Secret,
+		"notification secret":  r.Notifications[0].Secret,
+	}
+	for name, got := range secrets {
+		if got != "<redacted>" {
+			t.Errorf("%v = %q, want it redacted", name, got)
+		}
+	}
+
+	if got := r.Artifacts.S3.Bucket; got != "artifacts" {
+		t.Errorf("s3 bucket = %q, want %q", got, "artifacts")
+	}
+	if got := c.Artifacts.S3.AccessKeyID; got != "AKIAEXAMPLE" {
+		t.Errorf("Redacted() changed the original config, access key id = %q", got)
+	}
+	if got := c.Server.Auth.Tokens[0]; got != "api-token" {
+		t.Errorf("Redacted() changed the original config, auth token = %q", got)
+	}
+}
@@ -0,0 +1,201 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// newHookTask creates a lifecycle task running nomad-pipeline with the given
+// args. Unless the hooks config sets a driver, the driver and its config are
+// taken from the task that is processing the job (usually the init task), so
+// hooks run the same way the init task does, whether that is a container
+// image or a binary on the client.
+func newHookTask(name string, hook string, procTask *nomad.Task, hc HooksConfig, args []string) (*nomad.Task, error) {
+	driver := procTask.Driver
+	cfg := copyMapInterface(procTask.Config)
+
+	if len(hc.Driver) > 0 && hc.Driver != procTask.Driver {
+		driver = hc.Driver
+		cfg = make(map[string]interface{})
+	}
+
+	task := nomad.NewTask(name, driver)
+
+	task.Lifecycle = &nomad.TaskLifecycle{
+		Hook: hook,
+	}
+
+	switch driver {
+	case "docker", "podman":
+		if len(hc.Image) > 0 {
+			cfg["image"] = hc.Image
+		}
+		if _, ok := cfg["image"]; !ok {
+			return nil, fmt.Errorf("%v driver config of hook is missing image", driver)
+		}
+	case "exec", "raw_exec":
+		if len(hc.Command) > 0 {
+			cfg["command"] = hc.Command
+		}
+		if _, ok := cfg["command"]; !ok {
+			return nil, fmt.Errorf("%v driver config of hook is missing command", driver)
+		}
+	case "java":
+		if _, ok := cfg["jar_path"]; !ok {
+			if _, ok := cfg["class"]; !ok {
+				return nil, fmt.Errorf("java driver config of hook is missing jar_path or class")
+			}
+		}
+	default:
+		log.Warnf("driver (%v) not explicitly supported for hook tasks, copying config of task (%v) as is", driver, procTask.Name)
+	}
+
+	cfg["args"] = args
+	task.Config = cfg
+
+	// binaries and jars are usually fetched as artifacts, the hooks need
+	// them as much as the task they were copied from
+	if driver == procTask.Driver {
+		task.Artifacts = append(task.Artifacts, procTask.Artifacts...)
+	}
+
+	task.Env = copyMapString(procTask.Env)
+
+	hc.apply(task)
+
+	return task, nil
+}
+
+// HooksConfig sets how the injected hook tasks are run. The driver, image
+// and command default to the ones of the init task, zero values of the rest
+// are left for Nomad to default.
+type HooksConfig struct {
+	Driver      string             `yaml:"driver"`
+	Image       string             `yaml:"image"`
+	Command     string             `yaml:"command"`
+	CPU         int                `yaml:"cpu"`
+	MemoryMB    int                `yaml:"memory_mb"`
+	MemoryMaxMB int                `yaml:"memory_max_mb"`
+	KillTimeout time.Duration      `yaml:"kill_timeout"`
+	Restart     HooksRestartConfig `yaml:"restart"`
+	Logs        HooksLogsConfig    `yaml:"logs"`
+}
+
+type HooksRestartConfig struct {
+	Attempts *int          `yaml:"attempts"`
+	Delay    time.Duration `yaml:"delay"`
+	Interval time.Duration `yaml:"interval"`
+	Mode     string        `yaml:"mode"`
+}
+
+type HooksLogsConfig struct {
+	MaxFiles      int `yaml:"max_files"`
+	MaxFileSizeMB int `yaml:"max_file_size_mb"`
+}
+
+// withMeta returns a copy of the config overridden by any hook tags set in
+// the task group meta.
+func (hc HooksConfig) withMeta(meta map[string]string) (HooksConfig, error) {
+	var err error
+
+	ints := map[string]*int{
+		TagHookCPU:              &hc.CPU,
+		TagHookMemoryMB:         &hc.MemoryMB,
+		TagHookMemoryMaxMB:      &hc.MemoryMaxMB,
+		TagHookLogMaxFiles:      &hc.Logs.MaxFiles,
+		TagHookLogMaxFileSizeMB: &hc.Logs.MaxFileSizeMB,
+	}
+
+	for tag, value := range ints {
+		if _, ok := meta[tag]; !ok {
+			continue
+		}
+		*value, err = lookupMetaTagInt(meta, tag)
+		if err != nil {
+			return hc, err
+		}
+	}
+
+	if _, ok := meta[TagHookRestartAttempts]; ok {
+		attempts, err := lookupMetaTagInt(meta, TagHookRestartAttempts)
+		if err != nil {
+			return hc, err
+		}
+		hc.Restart.Attempts = i2p(attempts)
+	}
+
+	durations := map[string]*time.Duration{
+		TagHookKillTimeout:     &hc.KillTimeout,
+		TagHookRestartDelay:    &hc.Restart.Delay,
+		TagHookRestartInterval: &hc.Restart.Interval,
+	}
+
+	for tag, value := range durations {
+		if _, ok := meta[tag]; !ok {
+			continue
+		}
+		*value, err = lookupMetaTagDuration(meta, tag)
+		if err != nil {
+			return hc, err
+		}
+	}
+
+	if mode := lookupMetaTagStr(meta, TagHookRestartMode); len(mode) > 0 {
+		hc.Restart.Mode = mode
+	}
+
+	return hc, nil
+}
+
+func (hc HooksConfig) apply(task *nomad.Task) {
+	if hc.CPU > 0 || hc.MemoryMB > 0 || hc.MemoryMaxMB > 0 {
+		task.Resources = &nomad.Resources{}
+
+		if hc.CPU > 0 {
+			task.Resources.CPU = i2p(hc.CPU)
+		}
+		if hc.MemoryMB > 0 {
+			task.Resources.MemoryMB = i2p(hc.MemoryMB)
+		}
+		if hc.MemoryMaxMB > 0 {
+			task.Resources.MemoryMaxMB = i2p(hc.MemoryMaxMB)
+		}
+	}
+
+	if hc.KillTimeout > 0 {
+		killTimeout := hc.KillTimeout
+		task.KillTimeout = &killTimeout
+	}
+
+	restart := hc.Restart
+	if restart.Attempts != nil || restart.Delay > 0 || restart.Interval > 0 || len(restart.Mode) > 0 {
+		task.RestartPolicy = &nomad.RestartPolicy{}
+
+		if restart.Attempts != nil {
+			task.RestartPolicy.Attempts = i2p(*restart.Attempts)
+		}
+		if restart.Delay > 0 {
+			task.RestartPolicy.Delay = &restart.Delay
+		}
+		if restart.Interval > 0 {
+			task.RestartPolicy.Interval = &restart.Interval
+		}
+		if len(restart.Mode) > 0 {
+			task.RestartPolicy.Mode = &restart.Mode
+		}
+	}
+
+	if hc.Logs.MaxFiles > 0 || hc.Logs.MaxFileSizeMB > 0 {
+		task.LogConfig = &nomad.LogConfig{}
+
+		if hc.Logs.MaxFiles > 0 {
+			task.LogConfig.MaxFiles = i2p(hc.Logs.MaxFiles)
+		}
+		if hc.Logs.MaxFileSizeMB > 0 {
+			task.LogConfig.MaxFileSizeMB = i2p(hc.Logs.MaxFileSizeMB)
+		}
+	}
+}
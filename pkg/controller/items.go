@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+const (
+	// prefixes of the item sources that aren't inline lists
+	itemsFilePrefix = "file:"
+	itemsGlobPrefix = "glob:"
+
+	// env var holding the item of an allocation
+	itemEnvVar = "NOMAD_PIPELINE_ITEM"
+)
+
+// itemTemplate sets the item of the allocation, picked by its index from the
+// meta of the group, as an env var of the task.
+var itemTemplate = fmt.Sprintf(
+	`%s={{ env (printf "NOMAD_META_%s%%s" (env "NOMAD_ALLOC_INDEX")) | toJSON }}`,
+	itemEnvVar, TagItemPrefix,
+)
+
+// allocDir gives access to the files of the allocation triggering the next
+// groups, relative to its alloc dir.
+type allocDir interface {
+	ReadFile(name string) ([]byte, error)
+	Glob(pattern string) ([]string, error)
+}
+
+// localAllocDir is the alloc dir of the allocation the hook is running in.
+type localAllocDir string
+
+func (d localAllocDir) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+func (d localAllocDir) Glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(string(d), filepath.FromSlash(pattern)))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, match := range matches {
+		rel, err := filepath.Rel(string(d), match)
+		if err != nil {
+			return nil, err
+		}
+		matches[i] = filepath.ToSlash(rel)
+	}
+
+	return matches, nil
+}
+
+// remoteAllocDir reads the alloc dir of an allocation through the Nomad API.
+// Globs are only matched against the files of a single directory.
+type remoteAllocDir struct {
+	nomad *nomad.Client
+	alloc *nomad.Allocation
+}
+
+func newRemoteAllocDir(nClient *nomad.Client, allocID string) (*remoteAllocDir, error) {
+	alloc, _, err := nClient.Allocations().Info(allocID, &nomad.QueryOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting allocation: %w", err)
+	}
+
+	return &remoteAllocDir{nomad: nClient, alloc: alloc}, nil
+}
+
+func (d *remoteAllocDir) ReadFile(name string) ([]byte, error) {
+	r, err := d.nomad.AllocFS().Cat(d.alloc, path.Join("alloc", name), &nomad.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func (d *remoteAllocDir) Glob(pattern string) ([]string, error) {
+	dir := path.Dir(pattern)
+
+	files, _, err := d.nomad.AllocFS().List(d.alloc, path.Join("alloc", dir), &nomad.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]string, 0)
+	for _, f := range files {
+		name := path.Join(dir, f.Name)
+		if ok, _ := path.Match(pattern, name); ok {
+			matches = append(matches, name)
+		}
+	}
+
+	return matches, nil
+}
+
+// resolveItems returns the items of a group from its items tag, either an
+// inline comma separated list, the lines of a file (file:<path>) or the paths
+// matching a glob (glob:<pattern>), relative to the alloc dir.
+func resolveItems(source string, dir allocDir) ([]string, error) {
+	items := make([]string, 0)
+
+	switch {
+	case strings.HasPrefix(source, itemsFilePrefix):
+		if dir == nil {
+			return nil, fmt.Errorf("no alloc dir to read items file from")
+		}
+
+		content, err := dir.ReadFile(strings.TrimPrefix(source, itemsFilePrefix))
+		if err != nil {
+			return nil, fmt.Errorf("error reading items file: %w", err)
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); len(line) > 0 {
+				items = append(items, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading items file: %w", err)
+		}
+	case strings.HasPrefix(source, itemsGlobPrefix):
+		if dir == nil {
+			return nil, fmt.Errorf("no alloc dir to match items glob in")
+		}
+
+		matches, err := dir.Glob(strings.TrimPrefix(source, itemsGlobPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("error matching items glob: %w", err)
+		}
+		items = append(items, matches...)
+	default:
+		for _, item := range split(source) {
+			if len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// itemsMeta sets one instance per item on the group, each item is set as meta
+// under its index, for the item template to pick it up.
+func itemsMeta(tg *nomad.TaskGroup, items []string) {
+	for k := range tg.Meta {
+		if strings.HasPrefix(k, TagItemPrefix) {
+			delete(tg.Meta, k)
+		}
+	}
+
+	for i, item := range items {
+		tg.SetMeta(fmt.Sprintf("%s%d", TagItemPrefix, i), item)
+	}
+
+	tg.SetMeta(TagCount, fmt.Sprint(len(items)))
+}
+
+// addItemTemplate makes the item of the allocation available to the task as
+// the NOMAD_PIPELINE_ITEM env var, unless the task already has it.
+func addItemTemplate(task *nomad.Task) {
+	tmpl := itemTemplate
+	dest := "local/nomad-pipeline/item.env"
+
+	for _, t := range task.Templates {
+		if t.DestPath != nil && *t.DestPath == dest {
+			return
+		}
+	}
+	env := true
+	changeMode := "noop"
+
+	task.Templates = append(task.Templates, &nomad.Template{
+		EmbeddedTmpl: &tmpl,
+		DestPath:     &dest,
+		Envvars:      &env,
+		ChangeMode:   &changeMode,
+	})
+}
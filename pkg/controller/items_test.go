@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResolveItems(t *testing.T) {
+	root := t.TempDir()
+
+	files := map[string]string{
+		"items.txt":          "us-east-1\n\n  eu-west-1  \n",
+		"shards/shard-1.csv": "",
+		"shards/shard-2.csv": "",
+		"shards/README.md":   "",
+	}
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		source  string
+		dir     allocDir
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "inline",
+			source: "a, b,,c",
+			want:   []string{"a", "b", "c"},
+		},
+		{
+			name:   "empty inline",
+			source: "",
+			want:   []string{},
+		},
+		{
+			name:   "file",
+			source: "file:items.txt",
+			dir:    localAllocDir(root),
+			want:   []string{"us-east-1", "eu-west-1"},
+		},
+		{
+			name:   "glob",
+			source: "glob:shards/*.csv",
+			dir:    localAllocDir(root),
+			want:   []string{"shards/shard-1.csv", "shards/shard-2.csv"},
+		},
+		{
+			name:   "glob without matches",
+			source: "glob:shards/*.json",
+			dir:    localAllocDir(root),
+			want:   []string{},
+		},
+		{
+			name:    "missing file",
+			source:  "file:missing.txt",
+			dir:     localAllocDir(root),
+			wantErr: true,
+		},
+		{
+			name:    "invalid glob",
+			source:  "glob:shards/[",
+			dir:     localAllocDir(root),
+			wantErr: true,
+		},
+		{
+			name:    "file without alloc dir",
+			source:  "file:items.txt",
+			wantErr: true,
+		},
+		{
+			name:    "glob without alloc dir",
+			source:  "glob:shards/*.csv",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveItems(tt.source, tt.dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveItems(%q) error = %v, wantErr %v", tt.source, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveItems(%q) = %v, want %v", tt.source, got, tt.want)
+			}
+		})
+	}
+}
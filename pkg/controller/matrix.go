@@ -0,0 +1,206 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+type matrixAxis struct {
+	Key    string
+	Values []string
+}
+
+// parseMatrix parses a matrix tag, eg. region=us,eu;size=small,large. The
+// order of the axes is kept, it decides the names of the task groups.
+func parseMatrix(matrix string) ([]matrixAxis, error) {
+	axes := make([]matrixAxis, 0)
+	seen := make(map[string]bool)
+
+	for _, axis := range strings.Split(matrix, ";") {
+		axis = strings.TrimSpace(axis)
+		if len(axis) == 0 {
+			continue
+		}
+
+		key, values, ok := strings.Cut(axis, "=")
+		if !ok {
+			return nil, fmt.Errorf("axis (%v) is not a key=values pair", axis)
+		}
+
+		key = strings.TrimSpace(key)
+		if !outputKeyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("axis has an invalid key (%v), only letters, digits and underscores are allowed", key)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("axis (%v) is set more than once", key)
+		}
+		seen[key] = true
+
+		vs := make([]string, 0)
+		for _, v := range dedupStr(split(values)) {
+			if len(v) > 0 {
+				vs = append(vs, v)
+			}
+		}
+		if len(vs) == 0 {
+			return nil, fmt.Errorf("axis (%v) has no values", key)
+		}
+
+		axes = append(axes, matrixAxis{Key: key, Values: vs})
+	}
+
+	if len(axes) == 0 {
+		return nil, fmt.Errorf("matrix has no axes")
+	}
+
+	return axes, nil
+}
+
+// matrixCombinations returns every combination of the axes values, as a list
+// of values in the order of the axes.
+func matrixCombinations(axes []matrixAxis) [][]string {
+	combinations := [][]string{{}}
+
+	for _, axis := range axes {
+		next := make([][]string, 0, len(combinations)*len(axis.Values))
+		for _, c := range combinations {
+			for _, v := range axis.Values {
+				combination := append(append([]string{}, c...), v)
+				next = append(next, combination)
+			}
+		}
+		combinations = next
+	}
+
+	return combinations
+}
+
+func copyTaskGroup(tg *nomad.TaskGroup) (*nomad.TaskGroup, error) {
+	tgBytes, err := json.Marshal(tg)
+	if err != nil {
+		return nil, err
+	}
+
+	var tgCopy nomad.TaskGroup
+	err = json.Unmarshal(tgBytes, &tgCopy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tgCopy, nil
+}
+
+// expandMatrix replaces every task group with a matrix tag with one task group
+// per combination of the matrix, named <group>-<value>-<value>... Each value
+// is set as meta on its task group, so it's available as NOMAD_META_<key>.
+//
+// References to the original task group in the next, dependencies and inputs
+// tags of other task groups are replaced with all of its instances. Task
+// groups triggered by a matrix task group, without dependencies of their own,
+// depend on all instances, so they only run once the whole matrix finishes.
+func (pc *PipelineController) expandMatrix() error {
+	instances := make(map[string][]string)
+
+	// instances expanded before, eg. when processing dynamic tasks
+	for _, tGroup := range pc.Job.TaskGroups {
+		if mGroup := lookupMetaTagStr(tGroup.Meta, TagMatrixGroup); len(mGroup) > 0 {
+			instances[mGroup] = append(instances[mGroup], *tGroup.Name)
+		}
+	}
+
+	groups := make([]*nomad.TaskGroup, 0, len(pc.Job.TaskGroups))
+	for _, tGroup := range pc.Job.TaskGroups {
+		matrix := lookupMetaTagStr(tGroup.Meta, TagMatrix)
+		if len(matrix) == 0 || *tGroup.Name == pc.GroupName {
+			groups = append(groups, tGroup)
+			continue
+		}
+
+		axes, err := parseMatrix(matrix)
+		if err != nil {
+			return fmt.Errorf("error parsing matrix of task group (%v): %v", *tGroup.Name, err)
+		}
+
+		for _, combination := range matrixCombinations(axes) {
+			instance, err := copyTaskGroup(tGroup)
+			if err != nil {
+				return fmt.Errorf("error copying task group (%v): %v", *tGroup.Name, err)
+			}
+
+			name := strings.Join(append([]string{*tGroup.Name}, combination...), "-")
+			if pc.Job.LookupTaskGroup(name) != nil {
+				return fmt.Errorf("matrix task group (%v) conflicts with an existing task group", name)
+			}
+
+			instance.Name = &name
+			delete(instance.Meta, TagMatrix)
+			instance.SetMeta(TagMatrixGroup, *tGroup.Name)
+			for i, axis := range axes {
+				instance.SetMeta(axis.Key, combination[i])
+			}
+
+			instances[*tGroup.Name] = append(instances[*tGroup.Name], name)
+			groups = append(groups, instance)
+		}
+
+		log.Infof("expanded matrix task group (%v) into: %v", *tGroup.Name, instances[*tGroup.Name])
+	}
+
+	if len(instances) == 0 {
+		return nil
+	}
+
+	expand := func(refs []string) []string {
+		expanded := make([]string, 0, len(refs))
+		for _, ref := range refs {
+			group, glob, hasGlob := strings.Cut(ref, ":")
+			names, ok := instances[group]
+			if !ok {
+				expanded = append(expanded, ref)
+				continue
+			}
+			for _, name := range names {
+				if hasGlob {
+					name += ":" + glob
+				}
+				expanded = append(expanded, name)
+			}
+		}
+		return dedupStr(expanded)
+	}
+
+	for _, tGroup := range groups {
+		for _, tag := range []string{TagNext, TagDependencies, TagInputs} {
+			if refs := lookupMetaTagStr(tGroup.Meta, tag); len(refs) > 0 {
+				tGroup.SetMeta(tag, strings.Join(expand(split(refs)), ","))
+			}
+		}
+	}
+
+	deps := make(map[string][]string)
+	for _, tGroup := range groups {
+		mGroup := lookupMetaTagStr(tGroup.Meta, TagMatrixGroup)
+		if _, ok := instances[mGroup]; !ok {
+			continue
+		}
+
+		for _, next := range split(lookupMetaTagStr(tGroup.Meta, TagNext)) {
+			deps[next] = append(deps[next], instances[mGroup]...)
+		}
+	}
+
+	for _, tGroup := range groups {
+		if len(deps[*tGroup.Name]) == 0 || len(lookupMetaTagStr(tGroup.Meta, TagDependencies)) > 0 {
+			continue
+		}
+		tGroup.SetMeta(TagDependencies, strings.Join(dedupStr(deps[*tGroup.Name]), ","))
+	}
+
+	pc.Job.TaskGroups = groups
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMatrix(t *testing.T) {
+	tests := []struct {
+		name    string
+		matrix  string
+		want    []matrixAxis
+		wantErr bool
+	}{
+		{
+			name:   "single axis",
+			matrix: "region=us,eu",
+			want:   []matrixAxis{{Key: "region", Values: []string{"us", "eu"}}},
+		},
+		{
+			name:   "axes keep their order",
+			matrix: "size=small,large;region=us",
+			want: []matrixAxis{
+				{Key: "size", Values: []string{"small", "large"}},
+				{Key: "region", Values: []string{"us"}},
+			},
+		},
+		{
+			name:   "whitespace, empty and duplicate values",
+			matrix: " region = us , eu,,us ; ",
+			want:   []matrixAxis{{Key: "region", Values: []string{"us", "eu"}}},
+		},
+		{
+			name:    "empty",
+			matrix:  " ; ",
+			wantErr: true,
+		},
+		{
+			name:    "missing values",
+			matrix:  "region",
+			wantErr: true,
+		},
+		{
+			name:    "no values",
+			matrix:  "region= , ",
+			wantErr: true,
+		},
+		{
+			name:    "invalid key",
+			matrix:  "re-gion=us",
+			wantErr: true,
+		},
+		{
+			name:    "duplicate key",
+			matrix:  "region=us;region=eu",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMatrix(tt.matrix)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMatrix(%q) error = %v, wantErr %v", tt.matrix, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMatrix(%q) = %v, want %v", tt.matrix, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatrixCombinations(t *testing.T) {
+	axes := []matrixAxis{
+		{Key: "region", Values: []string{"us", "eu"}},
+		{Key: "size", Values: []string{"small", "large"}},
+	}
+
+	want := [][]string{
+		{"us", "small"},
+		{"us", "large"},
+		{"eu", "small"},
+		{"eu", "large"},
+	}
+
+	if got := matrixCombinations(axes); !reflect.DeepEqual(got, want) {
+		t.Errorf("matrixCombinations() = %v, want %v", got, want)
+	}
+}
+
+func TestExpandMatrix(t *testing.T) {
+	job := testJob(nil,
+		testGroup("build", 0, map[string]string{TagRoot: "true", TagNext: "test"}),
+		testGroup("test", 0, map[string]string{TagMatrix: "region=us,eu", TagDependencies: "build", TagNext: "report,e2e"}),
+		testGroup("e2e", 0, map[string]string{TagMatrix: "browser=chrome,firefox"}),
+		testGroup("report", 0, nil),
+		testGroup("deploy", 0, map[string]string{TagDependencies: "test", TagInputs: "test:out/*"}),
+	)
+	pc := PipelineController{Job: job, GroupName: "init"}
+
+	if err := pc.expandMatrix(); err != nil {
+		t.Fatalf("expandMatrix() error = %v", err)
+	}
+
+	groups := make([]string, 0)
+	for _, tg := range job.TaskGroups {
+		groups = append(groups, *tg.Name)
+	}
+	wantGroups := []string{"build", "test-us", "test-eu", "e2e-chrome", "e2e-firefox", "report", "deploy"}
+	if !reflect.DeepEqual(groups, wantGroups) {
+		t.Fatalf("groups = %v, want %v", groups, wantGroups)
+	}
+
+	wantMeta := map[string]map[string]string{
+		"build": {
+			TagNext: "test-us,test-eu",
+		},
+		"test-us": {
+			TagMatrix:       "",
+			TagMatrixGroup:  "test",
+			"region":        "us",
+			TagDependencies: "build",
+			TagNext:         "report,e2e-chrome,e2e-firefox",
+		},
+		"test-eu": {
+			TagMatrixGroup: "test",
+			"region":       "eu",
+		},
+		"e2e-chrome": {
+			TagMatrixGroup:  "e2e",
+			"browser":       "chrome",
+			TagDependencies: "test-us,test-eu",
+		},
+		"report": {
+			TagDependencies: "test-us,test-eu",
+		},
+		"deploy": {
+			TagDependencies: "test-us,test-eu",
+			TagInputs:       "test-us:out/*,test-eu:out/*",
+		},
+	}
+
+	for group, meta := range wantMeta {
+		tg := job.LookupTaskGroup(group)
+		for k, want := range meta {
+			if got := tg.Meta[k]; got != want {
+				t.Errorf("meta (%v) of group (%v) = %q, want %q", k, group, got, want)
+			}
+		}
+	}
+
+	// expanding again, eg. when dynamic tasks are added, keeps the instances
+	if err := pc.expandMatrix(); err != nil {
+		t.Fatalf("expandMatrix() again error = %v", err)
+	}
+	if len(job.TaskGroups) != len(wantGroups) {
+		t.Errorf("expanding again left %v groups, want %v", len(job.TaskGroups), len(wantGroups))
+	}
+	if got := job.LookupTaskGroup("build").Meta[TagNext]; got != "test-us,test-eu" {
+		t.Errorf("expanding again set next of build to %q", got)
+	}
+}
+
+func TestExpandMatrixConflict(t *testing.T) {
+	job := testJob(nil,
+		testGroup("test", 0, map[string]string{TagMatrix: "region=us,eu"}),
+		testGroup("test-us", 0, nil),
+	)
+	pc := PipelineController{Job: job, GroupName: "init"}
+
+	if err := pc.expandMatrix(); err == nil {
+		t.Error("expandMatrix() with a conflicting group didn't return an error")
+	}
+}
@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	log "github.com/sirupsen/logrus"
+)
+
+const MetricsNamespace = "nomad_pipeline"
+
+// MetricsRegistry holds the nomad-pipeline metrics. It is kept apart from the
+// default registry, so agents only push their own metrics and not the Go
+// runtime ones.
+var MetricsRegistry = prometheus.NewRegistry()
+
+var (
+	nomadRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "nomad",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of Nomad API requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "endpoint"})
+
+	nomadRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "nomad",
+		Name:      "request_errors_total",
+		Help:      "Nomad API requests that failed or returned an error status.",
+	}, []string{"method", "endpoint", "code"})
+
+	eventStreamReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "event_stream",
+		Name:      "reconnects_total",
+		Help:      "Reconnects of the Nomad event stream after an error.",
+	})
+
+	eventStreamPollFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "event_stream",
+		Name:      "poll_fallbacks_total",
+		Help:      "Times the event stream was unavailable and polling was used instead.",
+	})
+
+	hookDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "hook",
+		Name:      "duration_seconds",
+		Help:      "How long the agent hook ran for.",
+	}, []string{"hook"})
+
+	hookSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "hook",
+		Name:      "success",
+		Help:      "Whether the agent hook finished successfully.",
+	}, []string{"hook"})
+)
+
+var collectors = []prometheus.Collector{
+	nomadRequestDuration,
+	nomadRequestErrors,
+	eventStreamReconnects,
+	eventStreamPollFallbacks,
+	hookDuration,
+	hookSuccess,
+}
+
+func init() {
+	MetricsRegistry.MustRegister(collectors...)
+}
+
+// nomadEndpoint returns the resource of a Nomad API path, without any IDs,
+// e.g. /v1/job/example/allocations is job.
+func nomadEndpoint(path string) string {
+	parts := strings.Split(strings.TrimPrefix(path, "/v1/"), "/")
+	return parts[0]
+}
+
+// metricsTransport records the latency and errors of the Nomad API requests
+// going through it.
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := nomadEndpoint(req.URL.Path)
+	start := time.Now()
+
+	resp, err := t.next.RoundTrip(req)
+
+	nomadRequestDuration.WithLabelValues(req.Method, endpoint).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		nomadRequestErrors.WithLabelValues(req.Method, endpoint, "error").Inc()
+	} else if resp.StatusCode >= 400 {
+		nomadRequestErrors.WithLabelValues(req.Method, endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+	}
+
+	return resp, err
+}
+
+// PushMetrics pushes the metrics of the agent hook to the push gateway and
+// writes them to the textfile dir, if configured. Agent hooks are too short
+// lived to be scraped.
+func (pc *PipelineController) PushMetrics(hook string, start time.Time, success bool) {
+	cfg := pc.Config.Metrics
+	if len(cfg.PushGateway) == 0 && len(cfg.TextfileDir) == 0 {
+		return
+	}
+
+	hookDuration.WithLabelValues(hook).Set(time.Since(start).Seconds())
+
+	successValue := 0.0
+	if success {
+		successValue = 1
+	}
+	hookSuccess.WithLabelValues(hook).Set(successValue)
+
+	// every allocation and hook pushes its own metrics, the labels keep them
+	// apart
+	labels := prometheus.Labels{
+		"pipeline_job": pc.JobID,
+		"group":        pc.GroupName,
+		"alloc_id":     pc.AllocID,
+	}
+
+	reg := prometheus.NewRegistry()
+	for _, c := range collectors {
+		err := prometheus.WrapRegistererWith(labels, reg).Register(c)
+		if err != nil {
+			log.Warnf("error registering agent metrics: %v", err)
+			return
+		}
+	}
+
+	if len(cfg.PushGateway) > 0 {
+		err := push.New(cfg.PushGateway, "nomad_pipeline_agent").
+			Gatherer(reg).
+			Grouping("instance", fmt.Sprintf("%s-%s", pc.AllocID, hook)).
+			Push()
+		if err != nil {
+			log.Warnf("error pushing metrics: %v", err)
+		}
+	}
+
+	if len(cfg.TextfileDir) > 0 {
+		p := filepath.Join(cfg.TextfileDir, fmt.Sprintf("nomad-pipeline-%s-%s.prom", pc.AllocID, hook))
+
+		err := prometheus.WriteToTextfile(p, reg)
+		if err != nil {
+			log.Warnf("error writing metrics textfile: %v", err)
+		}
+	}
+}
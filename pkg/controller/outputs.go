@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputsFile is where tasks write their outputs, relative to NOMAD_ALLOC_DIR.
+// Each line is a KEY=value pair, empty lines and lines starting with # are
+// ignored.
+const OutputsFile = "nomad-pipeline/outputs.env"
+
+var outputKeyRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+func parseOutputs(r io.Reader) (map[string]string, error) {
+	outputs := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %v is not a KEY=value pair", n)
+		}
+
+		key = strings.TrimSpace(key)
+		if !outputKeyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("line %v has an invalid key (%v), only letters, digits and underscores are allowed", n, key)
+		}
+
+		outputs[key] = value
+	}
+
+	return outputs, scanner.Err()
+}
+
+// readOutputs reads the outputs written to the alloc dir, no outputs file
+// means no outputs.
+func readOutputs(allocDir string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(allocDir, OutputsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseOutputs(f)
+}
+
+// readAllocOutputs reads the outputs of an allocation through the Nomad API,
+// for when the alloc dir isn't available locally.
+func readAllocOutputs(dir *remoteAllocDir) (map[string]string, error) {
+	content, err := dir.ReadFile(OutputsFile)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such file") {
+			return map[string]string{}, nil
+		}
+		return nil, fmt.Errorf("error reading outputs file: %w", err)
+	}
+
+	return parseOutputs(bytes.NewReader(content))
+}
+
+// outputsMeta builds the meta passed to the groups triggered by group. The
+// outputs are namespaced under nomad-pipeline.outputs.<group>.<key>, outputs
+// the group itself received are passed along too. Every output is also set
+// as a plain <key>, so it's available as NOMAD_META_<key>, with the outputs of
+// the group taking precedence.
+func outputsMeta(tg *nomad.TaskGroup, outputs map[string]string) map[string]string {
+	meta := make(map[string]string)
+
+	for k, v := range tg.Meta {
+		if strings.HasPrefix(k, TagOutputsPrefix) {
+			meta[k] = v
+
+			key := k[strings.LastIndex(k, ".")+1:]
+			if _, ok := outputs[key]; !ok {
+				meta[key] = v
+			}
+		}
+	}
+
+	for k, v := range outputs {
+		meta[TagOutputsPrefix+*tg.Name+"."+k] = v
+		meta[k] = v
+	}
+
+	if len(outputs) > 0 {
+		log.Infof("passing outputs of group (%v) to the next groups: %v", *tg.Name, outputs)
+	}
+
+	return meta
+}
+
+// groupOutputs merges the outputs of the other allocations of the current
+// group, read through the Nomad API, with the outputs of the current one,
+// which take precedence.
+func (pc *PipelineController) groupOutputs(allocs []*nomad.AllocationListStub, outputs map[string]string) map[string]string {
+	merged := make(map[string]string)
+
+	for _, alloc := range latestAllocs(allocs) {
+		if alloc.TaskGroup != pc.GroupName || alloc.ID == pc.AllocID {
+			continue
+		}
+
+		rDir, err := newRemoteAllocDir(pc.Nomad, alloc.ID)
+		if err != nil {
+			log.Errorf("error reading allocation (%v): %v", alloc.ID, err)
+			continue
+		}
+
+		allocOutputs, err := readAllocOutputs(rDir)
+		if err != nil {
+			log.Errorf("error reading outputs of allocation (%v): %v", alloc.ID, err)
+			continue
+		}
+
+		for k, v := range allocOutputs {
+			merged[k] = v
+		}
+	}
+
+	for k, v := range outputs {
+		merged[k] = v
+	}
+
+	return merged
+}
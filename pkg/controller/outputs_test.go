@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+func TestParseOutputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			content: "",
+			want:    map[string]string{},
+		},
+		{
+			name:    "pairs",
+			content: "VERSION=1.2.3\nIMAGE=app:1.2.3\n",
+			want:    map[string]string{"VERSION": "1.2.3", "IMAGE": "app:1.2.3"},
+		},
+		{
+			name:    "comments and empty lines",
+			content: "# build outputs\n\n  VERSION=1.2.3  \n",
+			want:    map[string]string{"VERSION": "1.2.3"},
+		},
+		{
+			name:    "value with equal signs",
+			content: "QUERY=a=1&b=2",
+			want:    map[string]string{"QUERY": "a=1&b=2"},
+		},
+		{
+			name:    "empty value",
+			content: "EMPTY=",
+			want:    map[string]string{"EMPTY": ""},
+		},
+		{
+			name:    "key with spaces",
+			content: "VERSION = 1.2.3",
+			want:    map[string]string{"VERSION": " 1.2.3"},
+		},
+		{
+			name:    "last value wins",
+			content: "VERSION=1\nVERSION=2",
+			want:    map[string]string{"VERSION": "2"},
+		},
+		{
+			name:    "not a pair",
+			content: "VERSION",
+			wantErr: true,
+		},
+		{
+			name:    "invalid key",
+			content: "APP-VERSION=1.2.3",
+			wantErr: true,
+		},
+		{
+			name:    "key starting with a digit",
+			content: "1VERSION=1.2.3",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOutputs(strings.NewReader(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOutputs(%q) error = %v, wantErr %v", tt.content, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseOutputs(%q) = %v, want %v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadOutputs(t *testing.T) {
+	allocDir := t.TempDir()
+
+	got, err := readOutputs(allocDir)
+	if err != nil {
+		t.Fatalf("readOutputs() without outputs file error = %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("readOutputs() without outputs file = %v, want no outputs", got)
+	}
+
+	p := filepath.Join(allocDir, filepath.FromSlash(OutputsFile))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte("VERSION=1.2.3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = readOutputs(allocDir)
+	if err != nil {
+		t.Fatalf("readOutputs() error = %v", err)
+	}
+	if want := map[string]string{"VERSION": "1.2.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("readOutputs() = %v, want %v", got, want)
+	}
+}
+
+func TestOutputsMeta(t *testing.T) {
+	name := "test"
+	tg := &nomad.TaskGroup{
+		Name: &name,
+		Meta: map[string]string{
+			TagOutputsPrefix + "build.VERSION": "1.2.3",
+			TagOutputsPrefix + "build.IMAGE":   "app:1.2.3",
+			"owner":                            "team",
+		},
+	}
+
+	got := outputsMeta(tg, map[string]string{"VERSION": "1.2.4", "REPORT": "report.xml"})
+
+	want := map[string]string{
+		TagOutputsPrefix + "build.VERSION": "1.2.3",
+		TagOutputsPrefix + "build.IMAGE":   "app:1.2.3",
+		TagOutputsPrefix + "test.VERSION":  "1.2.4",
+		TagOutputsPrefix + "test.REPORT":   "report.xml",
+		"IMAGE":                            "app:1.2.3",
+		"VERSION":                          "1.2.4",
+		"REPORT":                           "report.xml",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("outputsMeta() = %v, want %v", got, want)
+	}
+}
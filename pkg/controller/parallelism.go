@@ -0,0 +1,144 @@
+package controller
+
+import (
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// groupParallelism returns the parallelism tag of the group, zero means no
+// limit.
+func groupParallelism(tg *nomad.TaskGroup) int {
+	parallelism, err := lookupMetaTagInt(tg.Meta, TagParallelism)
+	if err != nil {
+		log.Warnf("error parsing parallelism tag, defaulting to no limit: %v", err)
+		return 0
+	}
+	return parallelism
+}
+
+// groupTotalCount returns how many allocations the group runs in total once
+// triggered, see TagCount.
+func groupTotalCount(tg *nomad.TaskGroup) int {
+	count, err := lookupMetaTagInt(tg.Meta, TagCount)
+	if err != nil || count <= 0 {
+		return 1
+	}
+	return count
+}
+
+// initialCount is the count a group is scaled to when triggered, groups with
+// a parallelism start with the first batch only.
+func initialCount(tg *nomad.TaskGroup) int {
+	count := groupTotalCount(tg)
+	if parallelism := groupParallelism(tg); parallelism > 0 && parallelism < count {
+		return parallelism
+	}
+	return count
+}
+
+// finishedAllocs counts the allocations of the group whose tasks have all
+// finished, successfully or not.
+func finishedAllocs(allocs []*nomad.AllocationListStub, group string) int {
+	finished := 0
+	for _, alloc := range latestAllocs(allocs) {
+		if alloc.TaskGroup != group {
+			continue
+		}
+
+		if len(alloc.TaskStates) > 0 && allocDone(alloc, false) {
+			finished++
+		}
+	}
+	return finished
+}
+
+// releaseCount returns the count the group should be scaled to so that at most
+// parallelism allocations run at the same time, and if it differs from the
+// current count.
+func releaseCount(allocs []*nomad.AllocationListStub, tg *nomad.TaskGroup) (int, bool) {
+	parallelism := groupParallelism(tg)
+	if parallelism <= 0 || tg.Count == nil {
+		return 0, false
+	}
+
+	total := groupTotalCount(tg)
+	count := finishedAllocs(allocs, *tg.Name) + parallelism
+	if count > total {
+		count = total
+	}
+
+	return count, count > *tg.Count
+}
+
+// tgReleased checks if all allocations of the groups have been released, groups
+// limited by a parallelism aren't done until the last batch finishes, even if
+// all of their current allocations are.
+func tgReleased(job *nomad.Job, allocs []*nomad.AllocationListStub, groups []string) bool {
+	for _, group := range groups {
+		tg := job.LookupTaskGroup(group)
+		if tg == nil || groupParallelism(tg) <= 0 || Skipped(job, group) {
+			continue
+		}
+
+		allocated := 0
+		for _, alloc := range latestAllocs(allocs) {
+			if alloc.TaskGroup == group {
+				allocated++
+			}
+		}
+
+		if allocated < groupTotalCount(tg) {
+			return false
+		}
+	}
+	return true
+}
+
+// releaseDynamicTasks returns the root groups of a set of dynamic tasks that
+// can be triggered once the group finishes, so that at most the parallelism
+// of the parent group are running at the same time.
+func releaseDynamicTasks(job *nomad.Job, allocs []*nomad.AllocationListStub, tg *nomad.TaskGroup) []string {
+	parent := lookupMetaTagStr(tg.Meta, TagParentTask)
+	if len(parent) == 0 {
+		return nil
+	}
+
+	pGroup := job.LookupTaskGroup(parent)
+	if pGroup == nil {
+		return nil
+	}
+
+	parallelism := groupParallelism(pGroup)
+	if parallelism <= 0 {
+		return nil
+	}
+
+	running := 0
+	pending := make([]string, 0)
+	for _, sibling := range job.TaskGroups {
+		if *sibling.Name == *tg.Name || lookupMetaTagStr(sibling.Meta, TagParentTask) != parent {
+			continue
+		}
+
+		allocated := tgAllocated(allocs, []string{*sibling.Name})
+		if sibling.Count != nil && *sibling.Count > 0 && !TgDone(allocs, []string{*sibling.Name}, false) {
+			running++
+			continue
+		}
+
+		root, _ := lookupMetaTagBool(sibling.Meta, TagRoot)
+		if root && !allocated && (sibling.Count == nil || *sibling.Count == 0) {
+			pending = append(pending, *sibling.Name)
+		}
+	}
+
+	if running >= parallelism {
+		return nil
+	}
+
+	if len(pending) > parallelism-running {
+		pending = pending[:parallelism-running]
+	}
+
+	return pending
+}
@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"testing"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+func TestReleaseCount(t *testing.T) {
+	tests := []struct {
+		name      string
+		count     int
+		meta      map[string]string
+		statuses  []string
+		wantCount int
+		wantOK    bool
+	}{
+		{
+			name:     "no parallelism",
+			count:    5,
+			meta:     map[string]string{TagCount: "5"},
+			statuses: []string{allocComplete, allocRunning},
+		},
+		{
+			name:     "first batch running",
+			count:    2,
+			meta:     map[string]string{TagCount: "5", TagParallelism: "2"},
+			statuses: []string{allocRunning, allocRunning},
+		},
+		{
+			name:      "partial batch",
+			count:     2,
+			meta:      map[string]string{TagCount: "5", TagParallelism: "2"},
+			statuses:  []string{allocComplete, allocRunning},
+			wantCount: 3,
+			wantOK:    true,
+		},
+		{
+			name:      "failed allocation releases its slot",
+			count:     2,
+			meta:      map[string]string{TagCount: "5", TagParallelism: "2"},
+			statuses:  []string{allocFailed, allocRunning},
+			wantCount: 3,
+			wantOK:    true,
+		},
+		{
+			name:      "failed allocation in the last slot",
+			count:     4,
+			meta:      map[string]string{TagCount: "5", TagParallelism: "2"},
+			statuses:  []string{allocComplete, allocComplete, allocComplete, allocFailed},
+			wantCount: 5,
+			wantOK:    true,
+		},
+		{
+			name:      "final batch",
+			count:     5,
+			meta:      map[string]string{TagCount: "5", TagParallelism: "2"},
+			statuses:  []string{allocComplete, allocComplete, allocComplete, allocFailed, allocRunning},
+			wantCount: 5,
+		},
+		{
+			name:     "pending allocations don't count as finished",
+			count:    2,
+			meta:     map[string]string{TagCount: "5", TagParallelism: "2"},
+			statuses: []string{allocPending, allocRunning},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := testGroup("test", tt.count, tt.meta)
+
+			allocs := make([]*nomad.AllocationListStub, 0)
+			for i, status := range tt.statuses {
+				allocs = append(allocs, testAlloc("test", i, status))
+			}
+
+			count, ok := releaseCount(allocs, tg)
+			if ok != tt.wantOK || (ok && count != tt.wantCount) {
+				t.Errorf("releaseCount() = %v, %v, want %v, %v", count, ok, tt.wantCount, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTgReleased(t *testing.T) {
+	tests := []struct {
+		name     string
+		jobMeta  map[string]string
+		meta     map[string]string
+		statuses []string
+		want     bool
+	}{
+		{
+			name:     "no parallelism",
+			meta:     map[string]string{TagCount: "5"},
+			statuses: []string{allocComplete},
+			want:     true,
+		},
+		{
+			name:     "partial batches",
+			meta:     map[string]string{TagCount: "5", TagParallelism: "2"},
+			statuses: []string{allocComplete, allocComplete, allocRunning},
+		},
+		{
+			name:     "failed allocations in earlier batches",
+			meta:     map[string]string{TagCount: "3", TagParallelism: "2"},
+			statuses: []string{allocFailed, allocFailed},
+		},
+		{
+			name:     "final batch",
+			meta:     map[string]string{TagCount: "3", TagParallelism: "2"},
+			statuses: []string{allocComplete, allocFailed, allocRunning},
+			want:     true,
+		},
+		{
+			name:    "skipped group",
+			jobMeta: map[string]string{TagSkip: "test"},
+			meta:    map[string]string{TagCount: "3", TagParallelism: "2"},
+			want:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := testJob(tt.jobMeta, testGroup("test", 2, tt.meta))
+
+			allocs := make([]*nomad.AllocationListStub, 0)
+			for i, status := range tt.statuses {
+				allocs = append(allocs, testAlloc("test", i, status))
+			}
+
+			if got := tgReleased(job, allocs, []string{"test"}); got != tt.want {
+				t.Errorf("tgReleased() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
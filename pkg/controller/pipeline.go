@@ -5,33 +5,91 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	nomad "github.com/hashicorp/nomad/api"
 	log "github.com/sirupsen/logrus"
-	yaml "gopkg.in/yaml.v3"
 )
 
 const (
-	TagPrefix          = "nomad-pipeline"
-	TagEnabled         = TagPrefix + ".enabled"
-	TagCount           = TagPrefix + ".count"
-	TagDependencies    = TagPrefix + ".dependencies"
-	TagDynamicMemoryMB = TagPrefix + ".dynamic-memory-mb"
-	TagDynamicTasks    = TagPrefix + ".dynamic-tasks"
-	TagLeader          = TagPrefix + ".leader"
-	TagNext            = TagPrefix + ".next"
-	TagRoot            = TagPrefix + ".root"
+	TagPrefix               = "nomad-pipeline"
+	TagEnabled              = TagPrefix + ".enabled"
+	TagApproval             = TagPrefix + ".approval"
+	TagArtifacts            = TagPrefix + ".artifacts"
+	TagCount                = TagPrefix + ".count"
+	TagGroupTimeout         = TagPrefix + ".group-timeout"
+	TagDefaultsPrefix       = TagPrefix + ".defaults."
+	TagDependencies         = TagPrefix + ".dependencies"
+	TagDependencyPolicy     = TagPrefix + ".dependency-policy"
+	TagDynamicMemoryMB      = TagPrefix + ".dynamic-memory-mb"
+	TagDynamicTasks         = TagPrefix + ".dynamic-tasks"
+	TagHookCPU              = TagPrefix + ".hook-cpu"
+	TagHookMemoryMB         = TagPrefix + ".hook-memory-mb"
+	TagHookMemoryMaxMB      = TagPrefix + ".hook-memory-max-mb"
+	TagHookKillTimeout      = TagPrefix + ".hook-kill-timeout"
+	TagHookRestartAttempts  = TagPrefix + ".hook-restart-attempts"
+	TagHookRestartDelay     = TagPrefix + ".hook-restart-delay"
+	TagHookRestartInterval  = TagPrefix + ".hook-restart-interval"
+	TagHookRestartMode      = TagPrefix + ".hook-restart-mode"
+	TagHookLogMaxFiles      = TagPrefix + ".hook-log-max-files"
+	TagHookLogMaxFileSizeMB = TagPrefix + ".hook-log-max-file-size-mb"
+	TagInputs               = TagPrefix + ".inputs"
+	TagItems                = TagPrefix + ".items"
+	TagLeader               = TagPrefix + ".leader"
+	TagMatrix               = TagPrefix + ".matrix"
+	TagNext                 = TagPrefix + ".next"
+	TagOnly                 = TagPrefix + ".only"
+	TagOnTimeout            = TagPrefix + ".on-timeout"
+	TagOutputsPrefix        = TagPrefix + ".outputs."
+	TagParallelism          = TagPrefix + ".parallelism"
+	TagParentJob            = TagPrefix + ".parent-job"
+	TagPipeline             = TagPrefix + ".pipeline"
+	TagPipelineMeta         = TagPrefix + ".pipeline-meta"
+	TagRoot                 = TagPrefix + ".root"
+	TagScheduler            = TagPrefix + ".scheduler"
+	TagSkip                 = TagPrefix + ".skip"
+	TagSuccessThreshold     = TagPrefix + ".success-threshold"
+	TagTriggerPipeline      = TagPrefix + ".trigger-pipeline"
+	TagTriggerPipelineMeta  = TagPrefix + ".trigger-pipeline-meta"
+	TagTriggerPipelineWait  = TagPrefix + ".trigger-pipeline-wait"
+	TagTimeout              = TagPrefix + ".timeout"
+	TagWaitTimeout          = TagPrefix + ".wait-timeout"
+
+	// policies for when a dependency finishes unsuccessfully
+	DependencyPolicyFail     = "fail"
+	DependencyPolicySkip     = "skip"
+	DependencyPolicyContinue = "continue"
+
+	// who triggers the next task groups, the hooks injected into each task
+	// group or the pipeline server
+	SchedulerHooks  = "hooks"
+	SchedulerServer = "server"
+
+	// approval states of a group gated by TagApproval
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
 
 	// internal tags, not  meant to be set by user
 	TagInternalPrefix = TagPrefix + ".internal"
 	TagParentTask     = TagInternalPrefix + ".parent-task"
 	TagParentPipeline = TagInternalPrefix + ".parent-pipeline"
+	TagMatrixGroup    = TagInternalPrefix + ".matrix-group"
+	TagItemPrefix     = TagInternalPrefix + ".item."
+	TagTimedOut       = TagInternalPrefix + ".timed-out"
+	TagChildJobs      = TagInternalPrefix + ".child-jobs"
+	TagTriggeredAt    = TagInternalPrefix + ".triggered-at"
+	TagDependencySkip = TagInternalPrefix + ".dependency-skip"
+	TagApprovalState  = TagInternalPrefix + ".approval-state"
+	TagApprovalBy     = TagInternalPrefix + ".approval-by"
+	TagApprovalAt     = TagInternalPrefix + ".approval-at"
 )
 
 func i2p(i int) *int {
@@ -66,6 +124,15 @@ func dedupAllocs(dup []*nomad.AllocationListStub) []*nomad.AllocationListStub {
 	return dedup
 }
 
+func containsStr(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
 func equalStr(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -96,12 +163,6 @@ func copyMapString(og map[string]string) map[string]string {
 	return nm
 }
 
-func clearECh(ch <-chan *nomad.Events) {
-	for len(ch) > 0 {
-		<-ch
-	}
-}
-
 func lookupTask(tg *nomad.TaskGroup, tName string) *nomad.Task {
 	for _, t := range tg.Tasks {
 		if t.Name == tName {
@@ -172,16 +233,53 @@ func successState(state *nomad.TaskState) bool {
 	return true
 }
 
+func latestAllocs(allocs []*nomad.AllocationListStub) []*nomad.AllocationListStub {
+	// sort allocations from newest to oldest job version, rescheduled
+	// allocations share a name so fall back to creation order
+	sort.Slice(allocs, func(i, j int) bool {
+		if allocs[i].JobVersion != allocs[j].JobVersion {
+			return allocs[i].JobVersion > allocs[j].JobVersion
+		}
+		return allocs[i].CreateIndex > allocs[j].CreateIndex
+	})
+	// deduping will use the latest job version and remove older ones
+	// hence the prior sorting
+	return dedupAllocs(allocs)
+}
+
+// allocDone checks if all tasks of the allocation, except the hooks, have
+// finished, successfully if success is set.
+func allocDone(alloc *nomad.AllocationListStub, success bool) bool {
+	// the tasks of lost allocations are never updated, their client is gone
+	if alloc.ClientStatus == nomad.AllocClientStatusLost {
+		return !success
+	}
+
+	tasks := 0
+	dTasks := 0
+	for task, state := range alloc.TaskStates {
+		if task != "wait" && task != "next" {
+			tasks++
+
+			if state.State == "dead" && !state.FinishedAt.IsZero() {
+				if success && successState(state) {
+					dTasks++
+				} else if !success {
+					dTasks++
+				}
+			}
+		}
+	}
+
+	return tasks == dTasks
+}
+
 func TgDone(allocs []*nomad.AllocationListStub, groups []string, success bool) bool {
 	if len(groups) == 0 || len(allocs) == 0 {
 		return false
 	}
 
-	// sort allocations from newest to oldest job version
-	sort.Slice(allocs, func(i, j int) bool { return allocs[i].JobVersion > allocs[j].JobVersion })
-	// deduping will use the latest job version and remove older ones
-	// hence the prior sorting
-	allocs = dedupAllocs(allocs)
+	allocs = latestAllocs(allocs)
 
 	// keeps track of how many allocations a task group expects to be complete
 	groupCount := make(map[string]int, 0)
@@ -192,26 +290,8 @@ func TgDone(allocs []*nomad.AllocationListStub, groups []string, success bool) b
 	dGroupCount := make(map[string]int, 0)
 	for _, alloc := range allocs {
 		for _, group := range groups {
-			if alloc.TaskGroup == group {
-				tasks := 0
-				dTasks := 0
-				for task, state := range alloc.TaskStates {
-					if task != "wait" && task != "next" {
-						tasks++
-
-						if state.State == "dead" && !state.FinishedAt.IsZero() {
-							if success && successState(state) {
-								dTasks++
-							} else if !success {
-								dTasks++
-							}
-						}
-					}
-				}
-
-				if tasks == dTasks {
-					dGroupCount[group] += 1
-				}
+			if alloc.TaskGroup == group && allocDone(alloc, success) {
+				dGroupCount[group] += 1
 			}
 		}
 	}
@@ -237,6 +317,219 @@ func TgDone(allocs []*nomad.AllocationListStub, groups []string, success bool) b
 	return equalStr(groups, dGroups)
 }
 
+// successThreshold returns how many of the total allocations of the group need
+// to succeed, from its success threshold tag, either a count or a percentage.
+func successThreshold(tg *nomad.TaskGroup, total int) int {
+	threshold := lookupMetaTagStr(tg.Meta, TagSuccessThreshold)
+	if len(threshold) == 0 {
+		return total
+	}
+
+	if strings.HasSuffix(threshold, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(threshold, "%")), 64)
+		if err != nil || p < 0 || p > 100 {
+			log.Warnf("invalid success threshold (%v), defaulting to all allocations", threshold)
+			return total
+		}
+		return int(math.Ceil(float64(total) * p / 100))
+	}
+
+	count, err := strconv.Atoi(threshold)
+	if err != nil || count < 0 {
+		log.Warnf("invalid success threshold (%v), defaulting to all allocations", threshold)
+		return total
+	}
+	if count > total {
+		return total
+	}
+	return count
+}
+
+// TgSucceeded checks if all groups have finished with enough allocations
+// succeeding, taking into account the success threshold of each group and
+// the pipelines the groups wait on. Skipped groups have succeeded.
+func TgSucceeded(job *nomad.Job, allocs []*nomad.AllocationListStub, groups []string) bool {
+	return tgSucceeded(job, allocs, groups, true)
+}
+
+func tgSucceeded(job *nomad.Job, allocs []*nomad.AllocationListStub, groups []string, children bool) bool {
+	if len(groups) == 0 {
+		return false
+	}
+
+	allocs = latestAllocs(allocs)
+
+	for _, group := range groups {
+		// skipped groups never run, they count as successful
+		if Skipped(job, group) {
+			continue
+		}
+
+		tg := job.LookupTaskGroup(group)
+		if tg != nil && children && (childPending(tg, allocs) || childFailed(tg, allocs)) {
+			return false
+		}
+
+		if tg == nil || len(lookupMetaTagStr(tg.Meta, TagSuccessThreshold)) == 0 {
+			if !TgDone(allocs, []string{group}, true) {
+				return false
+			}
+			continue
+		}
+
+		if !TgDone(allocs, []string{group}, false) {
+			return false
+		}
+
+		total := 0
+		succeeded := 0
+		for _, alloc := range allocs {
+			if alloc.TaskGroup != group {
+				continue
+			}
+			total++
+			if allocDone(alloc, true) {
+				succeeded++
+			}
+		}
+
+		threshold := successThreshold(tg, total)
+		if succeeded < threshold {
+			return false
+		}
+
+		if succeeded < total {
+			log.Infof("group (%v) finished with %v/%v successful allocations, meeting threshold of %v, failed indexes: %v", group, succeeded, total, threshold, TgFailedIndexes(allocs, group))
+		}
+	}
+
+	return true
+}
+
+// TgFailedIndexes returns the indexes of the allocations of the group that
+// finished unsuccessfully.
+func TgFailedIndexes(allocs []*nomad.AllocationListStub, group string) []int {
+	indexes := make([]int, 0)
+
+	for _, alloc := range latestAllocs(allocs) {
+		if alloc.TaskGroup != group || !allocDone(alloc, false) || allocDone(alloc, true) {
+			continue
+		}
+
+		// allocation names are <job>.<group>[<index>]
+		start := strings.LastIndex(alloc.Name, "[")
+		end := strings.LastIndex(alloc.Name, "]")
+		if start < 0 || end < start {
+			continue
+		}
+
+		index, err := strconv.Atoi(alloc.Name[start+1 : end])
+		if err != nil {
+			continue
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	sort.Ints(indexes)
+
+	return indexes
+}
+
+// TgFailed returns the groups that have finished without enough allocations
+// succeeding. Groups with an allocation that Nomad is going to reschedule are
+// not considered failed yet.
+func TgFailed(job *nomad.Job, allocs []*nomad.AllocationListStub, groups []string) []string {
+	failed := make([]string, 0)
+
+	allocs = latestAllocs(allocs)
+
+	for _, group := range groups {
+		rescheduling := false
+		for _, alloc := range allocs {
+			if alloc.TaskGroup == group && len(alloc.FollowupEvalID) > 0 {
+				rescheduling = true
+			}
+		}
+		if rescheduling {
+			continue
+		}
+
+		if tg := job.LookupTaskGroup(group); tg != nil && childPending(tg, allocs) {
+			continue
+		}
+
+		if TgDone(allocs, []string{group}, false) && !TgSucceeded(job, allocs, []string{group}) {
+			failed = append(failed, group)
+		}
+	}
+
+	return failed
+}
+
+func validDependencyPolicy(policy string) bool {
+	switch policy {
+	case DependencyPolicyFail, DependencyPolicySkip, DependencyPolicyContinue:
+		return true
+	}
+	return false
+}
+
+// ServerScheduled checks if the job opted in to having its task groups
+// triggered by the pipeline server instead of the injected hooks.
+func ServerScheduled(job *nomad.Job) bool {
+	return lookupMetaTagStr(job.Meta, TagScheduler) == SchedulerServer
+}
+
+// tags that describe the shape of the DAG or act once per pipeline, these
+// can't be defaulted at the job level
+var nonDefaultableTags = map[string]bool{
+	TagEnabled:             true,
+	TagApproval:            true,
+	TagRoot:                true,
+	TagNext:                true,
+	TagDependencies:        true,
+	TagMatrix:              true,
+	TagPipeline:            true,
+	TagScheduler:           true,
+	TagSkip:                true,
+	TagOnly:                true,
+	TagLeader:              true,
+	TagTimeout:             true,
+	TagOnTimeout:           true,
+	TagTriggerPipeline:     true,
+	TagTriggerPipelineMeta: true,
+	TagTriggerPipelineWait: true,
+}
+
+// GroupTags returns the nomad-pipeline tags of the task group merged with the
+// nomad-pipeline.defaults.* tags of the job, tags set on the group win.
+func GroupTags(job *nomad.Job, tg *nomad.TaskGroup) map[string]string {
+	tags := make(map[string]string)
+
+	for k, v := range job.Meta {
+		if !strings.HasPrefix(k, TagDefaultsPrefix) {
+			continue
+		}
+
+		tag := TagPrefix + "." + strings.TrimPrefix(k, TagDefaultsPrefix)
+		if nonDefaultableTags[tag] || strings.HasPrefix(tag, TagInternalPrefix) {
+			log.Warnf("tag can't be set as a job level default, ignoring: %v", k)
+			continue
+		}
+
+		tags[tag] = v
+	}
+
+	for k, v := range tg.Meta {
+		if strings.HasPrefix(k, TagPrefix+".") {
+			tags[k] = v
+		}
+	}
+
+	return tags
+}
+
 func generateEnvVarSlugs() map[string]string {
 	envVars := []string{"JOB_ID", "JOB_NAME"}
 
@@ -272,6 +565,20 @@ func lookupMetaTagInt(meta map[string]string, tag string) (int, error) {
 	return value, nil
 }
 
+func lookupMetaTagDuration(meta map[string]string, tag string) (time.Duration, error) {
+	var value time.Duration
+	var err error
+
+	if valueStr, ok := meta[tag]; ok {
+		valuee := os.ExpandEnv(valueStr)
+		value, err = time.ParseDuration(valuee)
+		if err != nil {
+			return value, fmt.Errorf("can't convert tag (%v) of value (%v) to a duration", tag, valuee)
+		}
+	}
+	return value, nil
+}
+
 func lookupMetaTagStr(meta map[string]string, tag string) string {
 	var value string
 
@@ -295,28 +602,6 @@ func lookupMetaTagBool(meta map[string]string, tag string) (bool, error) {
 	return value, nil
 }
 
-func loadConfig(cPath string) *Config {
-	cBytes, err := os.ReadFile(cPath)
-
-	if errors.Is(err, os.ErrNotExist) {
-		log.Warnf("config file doesn't exist (path: %v)", cPath)
-		return nil
-	}
-
-	if err != nil {
-		log.Warnf("error loading config (path: %v): %v", cPath, err)
-		return nil
-	}
-
-	c := Config{}
-	err = yaml.Unmarshal(cBytes, &c)
-	if err != nil {
-		log.Fatalf("error reading config yaml: %v", err)
-	}
-
-	return &c
-}
-
 type Task struct {
 	Name         string
 	Next         []string
@@ -336,9 +621,6 @@ func (ts Tasks) LookupTask(name string) *Task {
 
 type TaskGroups []nomad.TaskGroup
 
-type Config struct {
-}
-
 type PipelineController struct {
 	JobID     string
 	GroupName string
@@ -353,19 +635,20 @@ type PipelineController struct {
 }
 
 func NewPipelineController(cPath string) *PipelineController {
+	config, err := LoadConfig(cPath)
+	if err != nil {
+		log.Fatalf("error loading config: %v", err)
+	}
+
 	pc := PipelineController{
 		JobID:     os.Getenv("NOMAD_JOB_ID"),
 		GroupName: os.Getenv("NOMAD_GROUP_NAME"),
 		TaskName:  os.Getenv("NOMAD_TASK_NAME"),
 		AllocID:   os.Getenv("NOMAD_ALLOC_ID"),
-		Config:    loadConfig(cPath),
+		Config:    config,
 	}
 
-	nClient, err := nomad.NewClient(&nomad.Config{
-		Address: os.Getenv("NOMAD_ADDR"),
-		Namespace: os.Getenv("NOMAD_NAMESPACE"),
-		Region: os.Getenv("NOMAD_REGION"),
-	})
+	nClient, err := config.Nomad.NewClient()
 	if err != nil {
 		log.Fatalf("error creating client: %v", err)
 	}
@@ -413,12 +696,22 @@ func (pc *PipelineController) ProcessTaskGroups(filters ...map[string]string) ([
 		}
 	}
 
+	err := pc.expandMatrix()
+	if err != nil {
+		return nil, fmt.Errorf("error expanding matrix task groups: %v", err)
+	}
+
 	rTasks := make([]string, 0)
 	tasks := make(Tasks, 0, len(pc.Job.TaskGroups))
 
 	procTG := pc.Job.LookupTaskGroup(pc.GroupName)
 	procTask := lookupTask(procTG, pc.TaskName)
 
+	serverScheduled := ServerScheduled(pc.Job)
+	if serverScheduled {
+		log.Info("job is scheduled by the pipeline server, only injecting hooks for dynamic tasks")
+	}
+
 	for _, tGroup := range pc.Job.TaskGroups {
 		// skip init group
 		if *tGroup.Name == pc.GroupName {
@@ -433,6 +726,14 @@ func (pc *PipelineController) ProcessTaskGroups(filters ...map[string]string) ([
 			}
 		}
 
+		// make job level defaults part of the group meta, so the hooks and
+		// everything else reading the group meta sees them
+		for k, v := range GroupTags(pc.Job, tGroup) {
+			if _, ok := tGroup.Meta[k]; !ok {
+				tGroup.SetMeta(k, v)
+			}
+		}
+
 		task := Task{
 			Name: *tGroup.Name,
 		}
@@ -490,45 +791,126 @@ func (pc *PipelineController) ProcessTaskGroups(filters ...map[string]string) ([
 			return nil, fmt.Errorf("dag controlled task must have a zero count: %v", task.Name)
 		}
 
-		env := copyMapString(procTask.Env)
+		dArgs := []string{"agent", "wait"}
+
+		waitTimeout, err := lookupMetaTagDuration(tGroup.Meta, TagWaitTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing wait timeout tag: %v", err)
+		}
+		if waitTimeout == 0 {
+			waitTimeout = pc.Config.Defaults.WaitTimeout
+		}
+		if waitTimeout > 0 {
+			dArgs = append(dArgs, "--timeout", waitTimeout.String())
+		}
+
+		policy := lookupMetaTagStr(tGroup.Meta, TagDependencyPolicy)
+		if len(policy) == 0 {
+			policy = pc.Config.Defaults.DependencyPolicy
+		}
+		if len(policy) > 0 {
+			if !validDependencyPolicy(policy) {
+				return nil, fmt.Errorf("invalid dependency policy (%v) in task (%v)", policy, task.Name)
+			}
+			dArgs = append(dArgs, "--dependency-policy", policy)
+		}
+
+		hooksCfg, err := pc.Config.Hooks.withMeta(tGroup.Meta)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing hook tags in task (%v): %v", task.Name, err)
+		}
 
-		dTask := nomad.NewTask("wait", "docker")
+		// sub-pipeline groups run a task dispatching the pipeline and waiting
+		// for it instead of their own tasks
+		if _, ok := tGroup.Meta[TagPipeline]; ok && lookupTask(tGroup, "pipeline") == nil {
+			pTask, err := newHookTask("pipeline", "", procTask, hooksCfg, []string{"agent", "pipeline"})
+			if err != nil {
+				return nil, fmt.Errorf("error creating pipeline task for task (%v): %v", task.Name, err)
+			}
 
-		dTask.Lifecycle = &nomad.TaskLifecycle{
-			Hook: nomad.TaskLifecycleHookPrestart,
+			pTask.Lifecycle = nil
+			tGroup.Tasks = []*nomad.Task{pTask}
 		}
 
-		dTaskCfg := copyMapInterface(procTask.Config)
-		dTaskCfg["args"] = append([]string{"agent", "wait"}, task.Dependencies...)
-		dTask.Config = dTaskCfg
+		// the hooks added when the group was processed before don't need the
+		// item
+		if len(lookupMetaTagStr(tGroup.Meta, TagItems)) > 0 {
+			for _, t := range tGroup.Tasks {
+				if t.Name != "wait" && t.Name != "next" {
+					addItemTemplate(t)
+				}
+			}
+		}
 
-		dTask.Env = env
+		inputs := lookupMetaTagStr(tGroup.Meta, TagInputs)
+		if len(inputs) > 0 {
+			dArgs = append(dArgs, "--inputs", inputs)
+		}
 
-		if len(task.Dependencies) > 0 {
-			tGroup.AddTask(dTask)
+		artifacts := lookupMetaTagStr(tGroup.Meta, TagArtifacts)
+		if len(artifacts) > 0 || len(inputs) > 0 {
+			err = pc.addArtifactsVolume(tGroup)
+			if err != nil {
+				return nil, fmt.Errorf("error adding artifacts volume to task (%v): %v", task.Name, err)
+			}
 		}
 
-		nTask := nomad.NewTask("next", "docker")
+		// inputs are downloaded by the wait hook, so it's needed even when
+		// there are no dependencies to wait for
+		// groups are processed again when dynamic tasks are added, they keep
+		// the hooks they already have
+		waitHook := (len(task.Dependencies) > 0 && !serverScheduled) || len(inputs) > 0
+		if waitHook && lookupTask(tGroup, "wait") == nil {
+			dTask, err := newHookTask("wait", nomad.TaskLifecycleHookPrestart, procTask, hooksCfg, append(dArgs, task.Dependencies...))
+			if err != nil {
+				return nil, fmt.Errorf("error creating wait hook for task (%v): %v", task.Name, err)
+			}
+
+			pc.mountArtifactsVolume(tGroup, dTask)
+			tGroup.AddTask(dTask)
+		}
 
-		nTask.Lifecycle = &nomad.TaskLifecycle{
-			Hook: nomad.TaskLifecycleHookPoststop,
+		// the server can't read dynamic tasks or artifacts from the alloc dir,
+		// or wait on triggered pipelines, so these groups still need the next
+		// hook
+		dynTasks := lookupMetaTagStr(tGroup.Meta, TagDynamicTasks)
+		trigger := lookupMetaTagStr(tGroup.Meta, TagTriggerPipeline)
+		if serverScheduled && len(dynTasks) == 0 && len(artifacts) == 0 && len(trigger) == 0 {
+			continue
+		}
+		if lookupTask(tGroup, "next") != nil {
+			continue
 		}
 
-		nArgs := append([]string{"agent", "next"}, task.Next...)
+		nArgs := []string{"agent", "next"}
 
-		if dynTasks := lookupMetaTagStr(tGroup.Meta, TagDynamicTasks); len(dynTasks) > 0 {
-			nArgs = append([]string{"agent", "next", "--dynamic-tasks", dynTasks}, task.Next...)
+		if len(dynTasks) > 0 {
+			nArgs = append(nArgs, "--dynamic-tasks", dynTasks)
 		}
 
-		nTaskCfg := copyMapInterface(procTask.Config)
-		nTaskCfg["args"] = nArgs
-		nTask.Config = nTaskCfg
+		if len(artifacts) > 0 {
+			nArgs = append(nArgs, "--artifacts", artifacts)
+		}
 
-		nTask.Env = env
+		nArgs = append(nArgs, task.Next...)
 
+		nTask, err := newHookTask("next", nomad.TaskLifecycleHookPoststop, procTask, hooksCfg, nArgs)
+		if err != nil {
+			return nil, fmt.Errorf("error creating next hook for task (%v): %v", task.Name, err)
+		}
+
+		pc.mountArtifactsVolume(tGroup, nTask)
 		tGroup.AddTask(nTask)
 	}
 
+	// the tasks and hooks of a group are part of the span of the group, see
+	// the tracing of the server
+	if pc.Config.Tracing.Enabled() {
+		for _, task := range tasks {
+			addTraceparent(pc.Job, pc.Job.LookupTaskGroup(task.Name))
+		}
+	}
+
 	return rTasks, nil
 }
 
@@ -548,123 +930,206 @@ func (pc *PipelineController) Init() bool {
 		log.Fatalf("couldn't find a root task group, need to set the root meta tag (%v)", TagRoot)
 	}
 
-	return pc.Next(rTasks, "")
+	return pc.Next(rTasks, "", "")
 }
 
-func (pc *PipelineController) Wait(groups []string) {
-	log.Infof("waiting for following groups: %v", groups)
+// dependenciesDone checks if there's no need to wait on the groups any longer,
+// and which of them finished unsuccessfully. With the continue policy, that's
+// once all groups finished, with the other policies as soon as one failed.
+func dependenciesDone(job *nomad.Job, allocs []*nomad.AllocationListStub, groups []string, policy string) (bool, []string) {
+	if !tgReleased(job, allocs, groups) {
+		return false, nil
+	}
 
-	jAllocs, meta, err := pc.JobsAPI.Allocations(pc.JobID, true, &nomad.QueryOptions{})
-	if err != nil {
-		log.Fatalf("error getting job allocations: %v", err)
+	if TgSucceeded(job, allocs, groups) {
+		return true, nil
+	}
+
+	failed := TgFailed(job, allocs, groups)
+	if len(failed) == 0 {
+		return false, nil
+	}
+
+	if policy == DependencyPolicyContinue {
+		for _, group := range groups {
+			if !Skipped(job, group) && !TgDone(allocs, []string{group}, false) {
+				return false, nil
+			}
+		}
 	}
 
-	if TgDone(jAllocs, groups, true) {
-		log.Info("all dependent task groups finished successfully")
-		return
+	return true, failed
+}
+
+// Wait blocks until all groups have finished. What happens when a group
+// finishes unsuccessfully is decided by the dependency policy:
+//   - fail: an error is returned straight away
+//   - skip: the current group is scaled down and true is returned
+//   - continue: the failure is ignored once all groups have finished
+//
+// An error is also returned if the timeout (when non-zero) is reached before
+// the groups finish.
+func (pc *PipelineController) Wait(groups []string, timeout time.Duration, policy string) (bool, error) {
+	if len(groups) == 0 {
+		return false, nil
 	}
 
-	allocStubStore := make(map[string]*nomad.AllocationListStub)
+	log.Infof("waiting for following groups: %v", groups)
 
-	// initialized alloc store with current state
-	for _, alloc := range jAllocs {
-		allocStubStore[alloc.ID] = alloc
+	if len(policy) == 0 {
+		policy = DependencyPolicyFail
+	}
+	if !validDependencyPolicy(policy) {
+		return false, fmt.Errorf("invalid dependency policy: %v", policy)
 	}
 
-	eClient := pc.Nomad.EventStream()
+	ctx := context.Background()
+	if timeout > 0 {
+		log.Infof("waiting for at most %v", timeout)
 
-	topics := map[nomad.Topic][]string{
-		nomad.TopicAllocation: {pc.JobID},
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
 	}
 
-	idx := meta.LastIndex
-	log.Debug("event start index: %v", idx)
+	skipped := false
 
-	eCh := make(<-chan *nomad.Events, 10)
-	sub := make(chan bool, 1)
-	cancel := func() {}
+	done := func(allocs []*nomad.AllocationListStub) (bool, error) {
+		ready, failed := dependenciesDone(pc.Job, allocs, groups, policy)
+		if !ready {
+			return false, nil
+		}
 
-	// initial subscription
-	sub <- true
+		if len(failed) == 0 {
+			log.Info("all dependent task groups finished successfully")
+			return true, nil
+		}
 
-	eErrs := 0
-	for {
-		select {
-		case <-sub:
-			log.Debug("subscribing to event stream")
-			ctx := context.Background()
-			ctx, cancel = context.WithCancel(ctx)
-			defer cancel()
-			eCh, err = eClient.Stream(ctx, topics, idx, &nomad.QueryOptions{})
-			if err != nil {
-				log.Fatalf("error subscribing to event stream: %v", err)
+		switch policy {
+		case DependencyPolicySkip:
+			log.Warnf("dependent task groups finished unsuccessfully, skipping group: %v", failed)
+			if err := pc.scaleDownGroup(failed); err != nil {
+				return true, fmt.Errorf("error skipping group: %w", err)
 			}
-		case es := <-eCh:
-			if eErrs > 5 {
-				log.Fatalf("too many errors in event stream")
+			skipped = true
+			return true, nil
+		case DependencyPolicyContinue:
+			log.Warnf("dependent task groups finished unsuccessfully, continuing anyway: %v", failed)
+			return true, nil
+		default:
+			return true, fmt.Errorf("dependent task groups finished unsuccessfully: %v", failed)
+		}
+	}
+
+	w := NewAllocWatcher(pc.Nomad, pc.Job)
+	w.MaxRetries = pc.Config.Retry.MaxRetries
+	w.MinBackoff = pc.Config.Retry.MinBackoff
+	w.MaxBackoff = pc.Config.Retry.MaxBackoff
+
+	err := w.Watch(ctx, done)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false, fmt.Errorf("timed out after %v waiting for task groups: %v", timeout, groups)
+	}
+
+	return skipped, err
+}
+
+// triggerGroups sets the count of the groups so they get allocated, groups
+// that are already running are left alone. The meta is set on the groups that
+// get triggered, a group's own meta isn't overridden unless it's a pipeline
+// tag. Skipped groups aren't allocated, the groups after them are triggered
+// instead.
+func (pc *PipelineController) triggerGroups(jAllocs []*nomad.AllocationListStub, groups []string, meta map[string]string, dir allocDir) {
+	groups = append([]string{}, groups...)
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(groups); i++ {
+		group := groups[i]
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+
+		tg := pc.Job.LookupTaskGroup(group)
+		if tg == nil {
+			log.Warnf("could not find next group %v", group)
+			continue
+		}
+		if Skipped(pc.Job, group) {
+			next := pc.skippedNext(jAllocs, tg)
+			log.Infof("group skipped, triggering the groups after it (group: %v): %v", group, next)
+			groups = append(groups, next...)
+			continue
+		}
+		if tgAllocated(jAllocs, []string{group}) && !TgDone(jAllocs, []string{group}, false) {
+			log.Warnf("next group already has allocations, skipping trigger: %v", group)
+			continue
+		}
+
+		for k, v := range meta {
+			if _, ok := tg.Meta[k]; ok && !strings.HasPrefix(k, TagPrefix+".") {
+				continue
 			}
-			if es.Err != nil && strings.Contains(es.Err.Error(), "invalid character 's' looking for beginning of value") {
-				log.Warn("server disconnected, resubscribing")
-				cancel()
-				clearECh(eCh)
-				sub <- true
+			tg.SetMeta(k, v)
+		}
+
+		if source := lookupMetaTagStr(tg.Meta, TagItems); len(source) > 0 {
+			items, err := resolveItems(source, dir)
+			if err != nil {
+				log.Errorf("error resolving items of group (%v), not triggering it: %v", group, err)
 				continue
 			}
-			if es.Err != nil {
-				log.Error("error in event stream: %v", es.Err)
-				eErrs++
+			if len(items) == 0 {
+				log.Warnf("no items found for group (%v), not triggering it", group)
 				continue
 			}
 
-			for _, e := range es.Events {
-				log.Debugf("==> idx: %v, topic: %v, type: %v", e.Index, e.Topic, e.Type)
-
-				idx = e.Index
+			log.Infof("triggering group (%v) with %v items", group, len(items))
+			itemsMeta(tg, items)
+		}
 
-				if e.Type != "AllocationUpdated" {
-					continue
-				}
+		if parkForApproval(tg) {
+			continue
+		}
 
-				alloc, err := e.Allocation()
-				if err != nil {
-					log.Errorf("error getting allocation from event stream: %v", err)
-					eErrs++
-					continue
-				}
-				if alloc == nil {
-					log.Errorf("allocation in event stream shouldn't be nil")
-					eErrs++
-					continue
-				}
+		// the group isn't running, so changing its meta doesn't restart
+		// anything
+		tg.SetMeta(TagTriggeredAt, time.Now().UTC().Format(time.RFC3339Nano))
+		tg.Count = i2p(initialCount(tg))
+	}
+}
 
-				log.Debugf("  |-> task group: %v, client status: %v", alloc.TaskGroup, alloc.ClientStatus)
-				for t, ts := range alloc.TaskStates {
-					log.Debugf("  |-> task: %v, state: %v, restarts: %v, failed: %v", t, ts.State, ts.Restarts, ts.Failed)
-				}
+// skipGroup marks the group as skipped because of the dependencies that
+// finished unsuccessfully, so it isn't mistaken for a failed group.
+func skipGroup(tg *nomad.TaskGroup, failed []string) {
+	tg.SetMeta(TagDependencySkip, fmt.Sprintf("dependencies finished unsuccessfully: %v", strings.Join(failed, ",")))
+}
 
-				// workaround for alloc.Stub() to work
-				alloc.Job = pc.Job
+// scaleDownGroup sets the count of the current group to zero using the latest
+// version of the job, stopping any of its allocations, and marks it as
+// skipped because of the failed dependencies.
+func (pc *PipelineController) scaleDownGroup(failed []string) error {
+	job, _, err := pc.JobsAPI.Info(pc.JobID, &nomad.QueryOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting job: %w", err)
+	}
 
-				allocStub := alloc.Stub()
-				allocStubStore[alloc.ID] = allocStub
+	pc.Job = job
 
-				log.Debugf("alloc store size %v", len(allocStubStore))
+	cGroup := pc.Job.LookupTaskGroup(pc.GroupName)
+	if cGroup == nil {
+		return fmt.Errorf("could not find current group: %v", pc.GroupName)
+	}
 
-				allocList := make([]*nomad.AllocationListStub, 0, len(allocStubStore))
-				for _, v := range allocStubStore {
-					allocList = append(allocList, v)
-				}
+	// the group is scaled down in the same update, so changing its meta
+	// doesn't restart anything
+	skipGroup(cGroup, failed)
+	cGroup.Count = i2p(0)
 
-				if TgDone(allocList, groups, true) {
-					log.Info("all dependent task groups finished successfully")
-					return
-				}
-			}
-		}
-	}
+	return pc.UpdateJob()
 }
 
-func (pc *PipelineController) Next(groups []string, dynTasks string) bool {
+func (pc *PipelineController) Next(groups []string, dynTasks string, artifacts string) bool {
 	log.Infof("triggering the following groups: %v", groups)
 
 	jAllocs, _, err := pc.JobsAPI.Allocations(pc.JobID, true, nil)
@@ -701,10 +1166,77 @@ func (pc *PipelineController) Next(groups []string, dynTasks string) bool {
 		}
 	}
 
+	succeeded := true
 	for _, t := range cTasks {
 		if !successState(cAlloc.TaskStates[t]) {
 			log.Warnf("task %v didn't run successfully, not triggering next group", t)
-			return false
+			succeeded = false
+			break
+		}
+	}
+
+	if succeeded && len(artifacts) > 0 {
+		err = pc.UploadArtifacts(context.Background(), artifacts)
+		if err != nil {
+			log.Fatalf("error uploading artifacts: %v", err)
+		}
+	}
+
+	// release the next batch of a group limited by a parallelism, the group
+	// only triggers its next groups once the last batch finishes. Failed
+	// allocations release their slot too, same as with the scheduler.
+	if count, ok := releaseCount(jAllocs, cGroup); ok {
+		log.Infof("releasing next batch of group, scaling to: %v", count)
+		cGroup.Count = i2p(count)
+		return true
+	}
+
+	if !succeeded {
+		return false
+	}
+
+	outputs, err := readOutputs(os.Getenv("NOMAD_ALLOC_DIR"))
+	if err != nil {
+		log.Fatalf("error reading outputs: %v", err)
+	}
+
+	groups = append(groups, releaseDynamicTasks(pc.Job, jAllocs, cGroup)...)
+
+	// the own next hook is still running, so waiting on a triggered pipeline
+	// doesn't count when checking if the group is done
+	groupDone := pc.TaskName == "init" || (tgReleased(pc.Job, jAllocs, []string{pc.GroupName}) && tgSucceeded(pc.Job, jAllocs, []string{pc.GroupName}, false))
+
+	// the allocation finishing the group passes on the outputs of all of
+	// its allocations, including earlier batches
+	if groupDone && pc.TaskName != "init" {
+		outputs = pc.groupOutputs(jAllocs, outputs)
+	}
+
+	// the pipeline is triggered once per group, by the allocation that
+	// finishes the group
+	var childID string
+	if len(lookupMetaTagStr(cGroup.Meta, TagTriggerPipeline)) > 0 && groupDone {
+		childID, err = pc.triggerPipeline(cGroup, outputs)
+		if err != nil {
+			log.Fatalf("error triggering pipeline: %v", err)
+		}
+
+		// waiting can take a while, continue with the latest job
+		if waitsOnChild(cGroup) {
+			pc.Job, _, err = pc.JobsAPI.Info(pc.JobID, &nomad.QueryOptions{})
+			if err != nil {
+				log.Fatalf("error getting job: %v", err)
+			}
+
+			jAllocs, _, err = pc.JobsAPI.Allocations(pc.JobID, true, nil)
+			if err != nil {
+				log.Fatalf("error getting job allocations: %v", err)
+			}
+
+			cGroup = pc.Job.LookupTaskGroup(pc.GroupName)
+			if cGroup == nil {
+				log.Fatalf("could not find current group (%v), this shouldn't happen!", pc.GroupName)
+			}
 		}
 	}
 
@@ -755,33 +1287,34 @@ func (pc *PipelineController) Next(groups []string, dynTasks string) bool {
 			log.Fatalf("no root task group found, atleast one task in dynamic tasks must have root meta tag (%v)", TagRoot)
 		}
 
+		if parallelism := groupParallelism(cGroup); parallelism > 0 && len(rTasks) > parallelism {
+			log.Infof("limiting dynamic tasks to %v at a time, pending: %v", parallelism, rTasks[parallelism:])
+			rTasks = rTasks[:parallelism]
+		}
+
 		groups = append(groups, rTasks...)
 	}
 
-	for _, group := range groups {
-		tg := pc.Job.LookupTaskGroup(group)
-		if tg == nil {
-			log.Warnf("could not find next group %v", group)
-			continue
-		}
-		if tgAllocated(jAllocs, []string{group}) && !TgDone(jAllocs, []string{group}, false) {
-			log.Warnf("next group already has allocations, skipping trigger: %v", group)
-			continue
-		}
+	pc.triggerGroups(jAllocs, groups, outputsMeta(cGroup, outputs), localAllocDir(os.Getenv("NOMAD_ALLOC_DIR")))
 
-		tg.Count = i2p(1)
-
-		count, err := lookupMetaTagInt(tg.Meta, TagCount)
+	if groupDone {
+		// sub-pipeline groups remember the job they dispatched in the alloc dir
+		subID, err := readChildJob("pipeline")
 		if err != nil {
-			log.Warn("error parsing count tag, defaulting to 1: %v", err)
-			count = 1
+			log.Warnf("error reading dispatched pipeline job: %v", err)
 		}
-		if count > 0 {
-			tg.Count = i2p(count)
+
+		for _, childID := range []string{childID, subID} {
+			if len(childID) == 0 {
+				continue
+			}
+
+			// the group is scaled down in the same update, so changing its
+			// meta doesn't restart anything
+			children := split(lookupMetaTagStr(cGroup.Meta, TagChildJobs))
+			cGroup.SetMeta(TagChildJobs, strings.Join(dedupStr(append(children, childID)), ","))
 		}
-	}
 
-	if pc.TaskName == "init" || TgDone(jAllocs, []string{pc.GroupName}, true) {
 		cGroup.Count = i2p(0)
 	}
 
@@ -0,0 +1,428 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+// statuses of the allocations built by testAlloc
+const (
+	allocPending  = "pending"
+	allocRunning  = "running"
+	allocComplete = "complete"
+	allocFailed   = "failed"
+	allocLost     = "lost"
+)
+
+// testAlloc builds an allocation of the group with a single main task in the
+// given status.
+func testAlloc(group string, index int, status string) *nomad.AllocationListStub {
+	alloc := &nomad.AllocationListStub{
+		ID:           fmt.Sprintf("%s-%d", group, index),
+		Name:         fmt.Sprintf("test.%s[%d]", group, index),
+		TaskGroup:    group,
+		ClientStatus: status,
+		TaskStates:   map[string]*nomad.TaskState{},
+	}
+
+	switch status {
+	case allocPending:
+		alloc.TaskStates["main"] = &nomad.TaskState{State: "pending"}
+	case allocRunning, allocLost:
+		alloc.TaskStates["main"] = &nomad.TaskState{State: "running"}
+	case allocComplete, allocFailed:
+		code := "0"
+		if status == allocFailed {
+			code = "1"
+		}
+		alloc.TaskStates["main"] = &nomad.TaskState{
+			State:      "dead",
+			Failed:     status == allocFailed,
+			FinishedAt: time.Unix(1, 0),
+			Events: []*nomad.TaskEvent{
+				{Type: nomad.TaskTerminated, Details: map[string]string{"exit_code": code}},
+			},
+		}
+	}
+
+	return alloc
+}
+
+// testGroup builds a task group with the count and meta.
+func testGroup(name string, count int, meta map[string]string) *nomad.TaskGroup {
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	return &nomad.TaskGroup{Name: &name, Count: &count, Meta: meta}
+}
+
+// testJob builds a pipeline job with the meta and task groups.
+func testJob(meta map[string]string, groups ...*nomad.TaskGroup) *nomad.Job {
+	id := "test"
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	meta[TagEnabled] = "true"
+	return &nomad.Job{ID: &id, Name: &id, Meta: meta, TaskGroups: groups}
+}
+
+func TestSuccessThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold string
+		total     int
+		want      int
+	}{
+		{name: "no threshold", total: 4, want: 4},
+		{name: "count", threshold: "2", total: 4, want: 2},
+		{name: "zero", threshold: "0", total: 4, want: 0},
+		{name: "count above total", threshold: "10", total: 4, want: 4},
+		{name: "percentage", threshold: "50%", total: 4, want: 2},
+		{name: "percentage rounds up", threshold: "50%", total: 3, want: 2},
+		{name: "percentage with spaces", threshold: " 75 %", total: 4, want: 3},
+		{name: "full percentage", threshold: "100%", total: 5, want: 5},
+		{name: "negative count", threshold: "-1", total: 4, want: 4},
+		{name: "percentage above 100", threshold: "150%", total: 4, want: 4},
+		{name: "invalid", threshold: "half", total: 4, want: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := &nomad.TaskGroup{Meta: map[string]string{}}
+			if len(tt.threshold) > 0 {
+				tg.Meta[TagSuccessThreshold] = tt.threshold
+			}
+
+			if got := successThreshold(tg, tt.total); got != tt.want {
+				t.Errorf("successThreshold(%q, %v) = %v, want %v", tt.threshold, tt.total, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTgSucceededAndFailed(t *testing.T) {
+	rescheduled := testAlloc("build", 1, allocLost)
+	rescheduled.FollowupEvalID = "eval"
+
+	tests := []struct {
+		name          string
+		jobMeta       map[string]string
+		meta          map[string]string
+		groups        []string
+		allocs        []*nomad.AllocationListStub
+		wantSucceeded bool
+		wantFailed    []string
+	}{
+		{
+			name:          "succeeded",
+			groups:        []string{"build"},
+			allocs:        []*nomad.AllocationListStub{testAlloc("build", 0, allocComplete), testAlloc("build", 1, allocComplete)},
+			wantSucceeded: true,
+		},
+		{
+			name:   "running",
+			groups: []string{"build"},
+			allocs: []*nomad.AllocationListStub{testAlloc("build", 0, allocComplete), testAlloc("build", 1, allocRunning)},
+		},
+		{
+			name:       "failed",
+			groups:     []string{"build"},
+			allocs:     []*nomad.AllocationListStub{testAlloc("build", 0, allocComplete), testAlloc("build", 1, allocFailed)},
+			wantFailed: []string{"build"},
+		},
+		{
+			name:       "lost",
+			groups:     []string{"build"},
+			allocs:     []*nomad.AllocationListStub{testAlloc("build", 0, allocComplete), testAlloc("build", 1, allocLost)},
+			wantFailed: []string{"build"},
+		},
+		{
+			name:   "lost and rescheduled",
+			groups: []string{"build"},
+			allocs: []*nomad.AllocationListStub{testAlloc("build", 0, allocComplete), rescheduled},
+		},
+		{
+			name:   "failed while others are running",
+			groups: []string{"build"},
+			allocs: []*nomad.AllocationListStub{testAlloc("build", 0, allocFailed), testAlloc("build", 1, allocRunning)},
+		},
+		{
+			name:          "success threshold met",
+			meta:          map[string]string{TagSuccessThreshold: "50%"},
+			groups:        []string{"build"},
+			allocs:        []*nomad.AllocationListStub{testAlloc("build", 0, allocComplete), testAlloc("build", 1, allocFailed)},
+			wantSucceeded: true,
+		},
+		{
+			name:       "success threshold not met",
+			meta:       map[string]string{TagSuccessThreshold: "2"},
+			groups:     []string{"build"},
+			allocs:     []*nomad.AllocationListStub{testAlloc("build", 0, allocComplete), testAlloc("build", 1, allocFailed)},
+			wantFailed: []string{"build"},
+		},
+		{
+			name:          "skipped",
+			jobMeta:       map[string]string{TagSkip: "build"},
+			groups:        []string{"build"},
+			wantSucceeded: true,
+		},
+		{
+			name:   "not allocated",
+			groups: []string{"build"},
+		},
+		{
+			name:   "mix of success and failure",
+			groups: []string{"build", "test"},
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocFailed),
+			},
+			wantFailed: []string{"test"},
+		},
+		{
+			name:   "mix of success and running",
+			groups: []string{"build", "test"},
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocRunning),
+			},
+		},
+		{
+			name:   "all failed",
+			groups: []string{"build", "test"},
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocFailed),
+				testAlloc("test", 0, allocLost),
+			},
+			wantFailed: []string{"build", "test"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := testJob(tt.jobMeta, testGroup("build", 0, tt.meta), testGroup("test", 0, nil))
+
+			if got := TgSucceeded(job, tt.allocs, tt.groups); got != tt.wantSucceeded {
+				t.Errorf("TgSucceeded() = %v, want %v", got, tt.wantSucceeded)
+			}
+
+			failed := TgFailed(job, tt.allocs, tt.groups)
+			if len(tt.wantFailed) == 0 {
+				tt.wantFailed = []string{}
+			}
+			if !reflect.DeepEqual(failed, tt.wantFailed) {
+				t.Errorf("TgFailed() = %v, want %v", failed, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestTgFailedIndexes(t *testing.T) {
+	allocs := []*nomad.AllocationListStub{
+		testAlloc("build", 0, allocComplete),
+		testAlloc("build", 1, allocFailed),
+		testAlloc("build", 2, allocRunning),
+		testAlloc("build", 3, allocLost),
+		testAlloc("test", 4, allocFailed),
+	}
+
+	if got, want := TgFailedIndexes(allocs, "build"), []int{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TgFailedIndexes() = %v, want %v", got, want)
+	}
+}
+
+func TestDependenciesDone(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		allocs     []*nomad.AllocationListStub
+		wantDone   bool
+		wantFailed []string
+	}{
+		{
+			name:   "running",
+			policy: DependencyPolicyFail,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocRunning),
+			},
+		},
+		{
+			name:   "succeeded",
+			policy: DependencyPolicyFail,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocComplete),
+			},
+			wantDone: true,
+		},
+		{
+			name:   "fail policy doesn't wait for the other groups",
+			policy: DependencyPolicyFail,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocFailed),
+				testAlloc("test", 0, allocRunning),
+			},
+			wantDone:   true,
+			wantFailed: []string{"build"},
+		},
+		{
+			name:   "skip policy doesn't wait for the other groups",
+			policy: DependencyPolicySkip,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocFailed),
+				testAlloc("test", 0, allocRunning),
+			},
+			wantDone:   true,
+			wantFailed: []string{"build"},
+		},
+		{
+			name:   "continue policy waits for the other groups",
+			policy: DependencyPolicyContinue,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocFailed),
+				testAlloc("test", 0, allocRunning),
+			},
+		},
+		{
+			name:   "continue policy once all groups finished",
+			policy: DependencyPolicyContinue,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocFailed),
+				testAlloc("test", 0, allocComplete),
+			},
+			wantDone:   true,
+			wantFailed: []string{"build"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := testJob(nil, testGroup("build", 0, nil), testGroup("test", 0, nil))
+
+			done, failed := dependenciesDone(job, tt.allocs, []string{"build", "test"}, tt.policy)
+			if done != tt.wantDone || !reflect.DeepEqual(failed, tt.wantFailed) {
+				t.Errorf("dependenciesDone() = %v, %v, want %v, %v", done, failed, tt.wantDone, tt.wantFailed)
+			}
+		})
+	}
+}
+
+// testController builds a controller processing the job from the init task of
+// its init group.
+func testController(job *nomad.Job) *PipelineController {
+	initTask := nomad.NewTask("init", "docker")
+	initTask.Config = map[string]interface{}{"image": "nomad-pipeline"}
+
+	initGroup := testGroup("init", 1, nil)
+	initGroup.Tasks = []*nomad.Task{initTask}
+	job.TaskGroups = append([]*nomad.TaskGroup{initGroup}, job.TaskGroups...)
+
+	return &PipelineController{
+		JobID:     *job.ID,
+		GroupName: "init",
+		TaskName:  "init",
+		Job:       job,
+		Config:    DefaultConfig(),
+	}
+}
+
+func TestProcessTaskGroupsTwice(t *testing.T) {
+	main := func() []*nomad.Task {
+		return []*nomad.Task{nomad.NewTask("main", "docker")}
+	}
+
+	build := testGroup("build", 0, map[string]string{TagRoot: "true", TagNext: "shard", TagItems: "a,b"})
+	build.Tasks = main()
+	shard := testGroup("shard", 0, map[string]string{TagDependencies: "build", TagNext: "deploy", TagArtifacts: "out/*"})
+	shard.Tasks = main()
+	deploy := testGroup("deploy", 0, map[string]string{TagDependencies: "shard", TagPipeline: "deploy-pipeline"})
+	deploy.Tasks = main()
+
+	pc := testController(testJob(nil, build, shard, deploy))
+	pc.Config.Tracing.Endpoint = "127.0.0.1:4318"
+	pc.Config.Artifacts.Store = ArtifactStoreLocal
+
+	if _, err := pc.ProcessTaskGroups(); err != nil {
+		t.Fatalf("ProcessTaskGroups() error = %v", err)
+	}
+
+	tasks := func(tg *nomad.TaskGroup) []string {
+		names := make([]string, 0)
+		for _, task := range tg.Tasks {
+			names = append(names, task.Name)
+		}
+		return names
+	}
+
+	want := map[string][]string{
+		"build":  {"main", "next"},
+		"shard":  {"main", "wait", "next"},
+		"deploy": {"pipeline", "wait", "next"},
+	}
+	for group, wantTasks := range want {
+		if got := tasks(pc.Job.LookupTaskGroup(group)); !reflect.DeepEqual(got, wantTasks) {
+			t.Errorf("tasks of group (%v) = %v, want %v", group, got, wantTasks)
+		}
+	}
+
+	first, err := json.Marshal(pc.Job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dynamic tasks process the task groups again
+	if _, err := pc.ProcessTaskGroups(map[string]string{TagParentTask: "build"}); err != nil {
+		t.Fatalf("ProcessTaskGroups() error = %v", err)
+	}
+
+	second, err := json.Marshal(pc.Job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(first) != string(second) {
+		t.Errorf("processing the task groups again changed the job")
+	}
+
+	if templates := pc.Job.LookupTaskGroup("build").Tasks[0].Templates; len(templates) != 1 {
+		t.Errorf("items group has %v templates, want 1", len(templates))
+	}
+}
+
+func TestGroupTags(t *testing.T) {
+	job := testJob(map[string]string{
+		TagDefaultsPrefix + "count":                 "2",
+		TagDefaultsPrefix + "dependency-policy":     "continue",
+		TagDefaultsPrefix + "group-timeout":         "1h",
+		TagDefaultsPrefix + "next":                  "deploy",
+		TagDefaultsPrefix + "leader":                "true",
+		TagDefaultsPrefix + "timeout":               "2h",
+		TagDefaultsPrefix + "on-timeout":            "cleanup",
+		TagDefaultsPrefix + "trigger-pipeline":      "release",
+		TagDefaultsPrefix + "trigger-pipeline-wait": "true",
+		TagDefaultsPrefix + "internal.triggered-at": "0",
+		TagTimeout: "3h",
+	})
+	tg := testGroup("build", 0, map[string]string{
+		TagCount:    "3",
+		TagRoot:     "true",
+		"not-a-tag": "value",
+	})
+
+	want := map[string]string{
+		TagCount:            "3",
+		TagDependencyPolicy: "continue",
+		TagGroupTimeout:     "1h",
+		TagRoot:             "true",
+	}
+
+	if got := GroupTags(job, tg); !reflect.DeepEqual(got, want) {
+		t.Errorf("GroupTags() = %v, want %v", got, want)
+	}
+}
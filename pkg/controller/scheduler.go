@@ -0,0 +1,453 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Scheduler triggers the next task groups of pipeline jobs that opted in to
+// being scheduled by the pipeline server (see TagScheduler). It replaces the
+// injected wait and next hooks by watching allocations of all jobs centrally.
+type Scheduler struct {
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	PollInterval time.Duration
+
+	config  *Config
+	nomad   *nomad.Client
+	jobsAPI *nomad.Jobs
+	index   uint64
+
+	// pipelines are the IDs of the jobs scheduled by the server, so
+	// allocation events of other jobs are ignored without looking them up
+	pipelines map[string]bool
+}
+
+func NewScheduler(config *Config) (*Scheduler, error) {
+	nClient, err := config.Nomad.NewClient()
+	if err != nil {
+		return nil, fmt.Errorf("error creating client: %w", err)
+	}
+
+	s := Scheduler{
+		MinBackoff:   config.Retry.MinBackoff,
+		MaxBackoff:   config.Retry.MaxBackoff,
+		PollInterval: 10 * time.Second,
+		config:       config,
+		nomad:        nClient,
+		jobsAPI:      nClient.Jobs(),
+		pipelines:    make(map[string]bool),
+	}
+
+	return &s, nil
+}
+
+// Run reconciles all pipeline jobs and then keeps reconciling jobs as their
+// allocations finish, until the context is done. If the event stream is
+// unavailable, all jobs are reconciled periodically instead.
+func (s *Scheduler) Run(ctx context.Context) error {
+	log.Info("starting pipeline scheduler")
+
+	// catch up with anything that finished while the scheduler wasn't running
+	s.reconcileAll()
+
+	failures := 0
+	for {
+		received, err := s.stream(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if streamUnavailable(err) {
+			log.Warnf("event stream unavailable, falling back to polling every %v: %v", s.PollInterval, err)
+			return s.poll(ctx)
+		}
+
+		if received {
+			failures = 0
+		}
+		failures++
+
+		backoff := BackoffDuration(s.MinBackoff, s.MaxBackoff, failures)
+		log.Warnf("error watching allocations, retrying in %v: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (s *Scheduler) poll(ctx context.Context) error {
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			s.reconcileAll()
+		}
+	}
+}
+
+func (s *Scheduler) stream(ctx context.Context) (bool, error) {
+	sCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// job events keep track of which jobs are pipelines, allocation events
+	// of those jobs trigger a reconcile
+	topics := map[nomad.Topic][]string{
+		nomad.TopicJob:        {"*"},
+		nomad.TopicAllocation: {"*"},
+	}
+
+	log.Debugf("subscribing to event stream from index: %v", s.index)
+
+	eCh, err := s.nomad.EventStream().Stream(sCtx, topics, s.index, &nomad.QueryOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	received := false
+	for {
+		select {
+		case <-ctx.Done():
+			return received, ctx.Err()
+		case es, ok := <-eCh:
+			if !ok {
+				return received, fmt.Errorf("event stream closed")
+			}
+			if es.Err != nil {
+				return received, fmt.Errorf("error in event stream: %w", es.Err)
+			}
+
+			received = true
+
+			// a job is reconciled once per batch of events, however many of
+			// its allocations finished
+			jobIDs := make([]string, 0)
+			seen := make(map[string]bool)
+
+			for _, e := range es.Events {
+				if e.Index > s.index {
+					s.index = e.Index
+				}
+
+				switch e.Topic {
+				case nomad.TopicJob:
+					s.trackJob(e)
+					continue
+				case nomad.TopicAllocation:
+				default:
+					continue
+				}
+
+				if e.Type != "AllocationUpdated" {
+					continue
+				}
+
+				alloc, err := e.Allocation()
+				if err != nil || alloc == nil {
+					log.Errorf("error getting allocation from event stream: %v", err)
+					continue
+				}
+
+				if !s.pipelines[alloc.JobID] || seen[alloc.JobID] {
+					continue
+				}
+
+				switch alloc.ClientStatus {
+				case nomad.AllocClientStatusComplete, nomad.AllocClientStatusFailed, nomad.AllocClientStatusLost:
+				default:
+					continue
+				}
+
+				seen[alloc.JobID] = true
+				jobIDs = append(jobIDs, alloc.JobID)
+			}
+
+			for _, jobID := range jobIDs {
+				err := s.reconcile(jobID)
+				if err != nil {
+					log.Errorf("error reconciling job (%v): %v", jobID, err)
+				}
+			}
+		}
+	}
+}
+
+// scheduled checks if the job is a pipeline scheduled by the server.
+func scheduled(job *nomad.Job) bool {
+	_, ok := job.Meta[TagEnabled]
+	return ok && ServerScheduled(job) && !job.IsParameterized()
+}
+
+// trackJob keeps the pipelines up to date with the job events.
+func (s *Scheduler) trackJob(e nomad.Event) {
+	job, err := e.Job()
+	if err != nil || job == nil || job.ID == nil {
+		log.Errorf("error getting job from event stream: %v", err)
+		return
+	}
+
+	switch e.Type {
+	case "JobDeregistered", "JobBatchDeregistered":
+		delete(s.pipelines, *job.ID)
+	default:
+		if scheduled(job) {
+			s.pipelines[*job.ID] = true
+		} else {
+			delete(s.pipelines, *job.ID)
+		}
+	}
+}
+
+func (s *Scheduler) reconcileAll() {
+	jobs, _, err := s.jobsAPI.List(&nomad.QueryOptions{})
+	if err != nil {
+		log.Errorf("error listing jobs: %v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		if job.ParameterizedJob || job.Status == "dead" {
+			continue
+		}
+
+		err = s.reconcile(job.ID)
+		if err != nil {
+			log.Errorf("error reconciling job (%v): %v", job.ID, err)
+		}
+	}
+}
+
+// reconcile does what the next hooks would have done for every task group
+// of the job that finished. Finished task groups are scaled down as part of
+// the same job update, so a task group is only ever handled once.
+func (s *Scheduler) reconcile(jobID string) error {
+	job, _, err := s.jobsAPI.Info(jobID, &nomad.QueryOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting job: %w", err)
+	}
+
+	if !scheduled(job) {
+		delete(s.pipelines, jobID)
+		return nil
+	}
+	s.pipelines[jobID] = true
+
+	jAllocs, _, err := s.jobsAPI.Allocations(jobID, true, &nomad.QueryOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting job allocations: %w", err)
+	}
+
+	pc := PipelineController{
+		JobID:     jobID,
+		Job:       job,
+		Nomad:     s.nomad,
+		JobsAPI:   s.jobsAPI,
+		AllocsAPI: s.nomad.Allocations(),
+		Config:    s.config,
+	}
+
+	update := false
+	for _, tg := range job.TaskGroups {
+		if tg.Count == nil || *tg.Count == 0 {
+			continue
+		}
+
+		// groups with hooks trigger their next groups themselves
+		if lookupTask(tg, "init") != nil || lookupTask(tg, "next") != nil {
+			continue
+		}
+
+		if count, ok := releaseCount(jAllocs, tg); ok {
+			log.Infof("releasing next batch of group (job: %v, group: %v), scaling to: %v", jobID, *tg.Name, count)
+			tg.Count = i2p(count)
+			update = true
+			continue
+		}
+
+		if !tgReleased(job, jAllocs, []string{*tg.Name}) || !TgDone(jAllocs, []string{*tg.Name}, false) {
+			continue
+		}
+
+		leader, err := lookupMetaTagBool(tg.Meta, TagLeader)
+		if err != nil {
+			log.Warnf("error parsing leader, default to false: %v", err)
+		}
+		if leader {
+			log.Infof("leader group finished, stopping all groups (job: %v, group: %v)", jobID, *tg.Name)
+			for _, _tg := range job.TaskGroups {
+				_tg.Count = i2p(0)
+			}
+			update = true
+			break
+		}
+
+		succeeded := TgSucceeded(job, jAllocs, []string{*tg.Name})
+
+		next, skipped := nextGroups(job, jAllocs, tg, s.config.Defaults.DependencyPolicy, !succeeded)
+		if succeeded {
+			next = append(releaseDynamicTasks(job, jAllocs, tg), next...)
+		} else if len(next) == 0 && skipped == 0 {
+			log.Warnf("group didn't run successfully, not triggering next group (job: %v, group: %v)", jobID, *tg.Name)
+			continue
+		}
+
+		log.Infof("group finished, triggering the following groups (job: %v, group: %v): %v", jobID, *tg.Name, next)
+
+		outputs := make(map[string]string)
+		var dir allocDir
+		for _, alloc := range latestAllocs(jAllocs) {
+			if alloc.TaskGroup != *tg.Name {
+				continue
+			}
+
+			rDir, err := newRemoteAllocDir(s.nomad, alloc.ID)
+			if err != nil {
+				log.Errorf("error reading allocation (%v): %v", alloc.ID, err)
+				continue
+			}
+
+			// items are read from one of the allocations of the group
+			if dir == nil {
+				dir = rDir
+			}
+
+			allocOutputs, err := readAllocOutputs(rDir)
+			if err != nil {
+				log.Errorf("error reading outputs of allocation (%v): %v", alloc.ID, err)
+				continue
+			}
+
+			for k, v := range allocOutputs {
+				outputs[k] = v
+			}
+		}
+
+		pc.triggerGroups(jAllocs, next, outputsMeta(tg, outputs), dir)
+		tg.Count = i2p(0)
+		update = true
+	}
+
+	if !update {
+		return nil
+	}
+
+	return pc.UpdateJob()
+}
+
+// nextGroups returns the next groups of a finished group that can be
+// triggered, and how many were skipped because of their dependency policy.
+// After a failed group, only the groups depending on it with a policy other
+// than fail are considered, the way their wait hook would.
+func nextGroups(job *nomad.Job, allocs []*nomad.AllocationListStub, tg *nomad.TaskGroup, defaultPolicy string, failed bool) ([]string, int) {
+	next := make([]string, 0)
+	skipped := 0
+
+	nextTag := lookupMetaTagStr(tg.Meta, TagNext)
+	if len(nextTag) == 0 {
+		return next, skipped
+	}
+
+	for _, group := range split(nextTag) {
+		nTG := job.LookupTaskGroup(group)
+		if nTG == nil {
+			log.Warnf("could not find next group %v", group)
+			continue
+		}
+
+		if failed {
+			dependencies := split(lookupMetaTagStr(nTG.Meta, TagDependencies))
+			if dependencyPolicy(nTG, defaultPolicy) == DependencyPolicyFail || !containsStr(dependencies, *tg.Name) {
+				continue
+			}
+		}
+
+		if !dependenciesReady(job, allocs, nTG, defaultPolicy) {
+			continue
+		}
+
+		// there's no wait hook to scale the group down, so it's skipped
+		// before it's triggered
+		if failedDeps := skippedDependencies(job, allocs, nTG, defaultPolicy); len(failedDeps) > 0 {
+			log.Warnf("dependent task groups finished unsuccessfully, skipping group (job: %v, group: %v): %v", *job.ID, group, failedDeps)
+			skipGroup(nTG, failedDeps)
+			skipped++
+			continue
+		}
+
+		next = append(next, group)
+	}
+
+	return next, skipped
+}
+
+func dependencyPolicy(tg *nomad.TaskGroup, defaultPolicy string) string {
+	policy := lookupMetaTagStr(tg.Meta, TagDependencyPolicy)
+	if len(policy) == 0 {
+		return defaultPolicy
+	}
+	return policy
+}
+
+// skippedDependencies returns the dependencies that finished unsuccessfully,
+// if the group has to be skipped because of them.
+func skippedDependencies(job *nomad.Job, allocs []*nomad.AllocationListStub, tg *nomad.TaskGroup, defaultPolicy string) []string {
+	if dependencyPolicy(tg, defaultPolicy) != DependencyPolicySkip {
+		return nil
+	}
+
+	dependencies := lookupMetaTagStr(tg.Meta, TagDependencies)
+	if len(dependencies) == 0 {
+		return nil
+	}
+
+	return TgFailed(job, allocs, split(dependencies))
+}
+
+// dependenciesReady checks if all dependencies of the group have finished,
+// taking into account the dependency policy of the group. Groups with the
+// skip policy are ready once all dependencies finished, so they can be
+// skipped.
+func dependenciesReady(job *nomad.Job, allocs []*nomad.AllocationListStub, tg *nomad.TaskGroup, defaultPolicy string) bool {
+	dependencies := lookupMetaTagStr(tg.Meta, TagDependencies)
+	if len(dependencies) == 0 {
+		return true
+	}
+
+	groups := split(dependencies)
+
+	if !tgReleased(job, allocs, groups) {
+		return false
+	}
+
+	if TgSucceeded(job, allocs, groups) {
+		return true
+	}
+
+	policy := dependencyPolicy(tg, defaultPolicy)
+
+	if policy != DependencyPolicyContinue && policy != DependencyPolicySkip {
+		if failed := TgFailed(job, allocs, groups); len(failed) > 0 {
+			log.Warnf("dependent task groups finished unsuccessfully, not triggering group (%v): %v", *tg.Name, failed)
+		}
+		return false
+	}
+
+	for _, group := range groups {
+		if !Skipped(job, group) && !TgDone(allocs, []string{group}, false) {
+			return false
+		}
+	}
+
+	return true
+}
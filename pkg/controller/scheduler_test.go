@@ -0,0 +1,367 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+// fakeNomad serves the job and its allocations like the Nomad API, the job
+// registered through it is kept in registered.
+type fakeNomad struct {
+	job        *nomad.Job
+	allocs     []*nomad.AllocationListStub
+	registered *nomad.Job
+}
+
+func (f *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/job/"+*f.job.ID:
+		_ = json.NewEncoder(w).Encode(f.job)
+	case r.URL.Path == "/v1/job/"+*f.job.ID+"/allocations":
+		_ = json.NewEncoder(w).Encode(f.allocs)
+	case strings.HasPrefix(r.URL.Path, "/v1/allocation/"):
+		_ = json.NewEncoder(w).Encode(nomad.Allocation{ID: strings.TrimPrefix(r.URL.Path, "/v1/allocation/")})
+	case strings.HasPrefix(r.URL.Path, "/v1/client/fs/cat/"):
+		http.Error(w, "no such file or directory", http.StatusInternalServerError)
+	case r.URL.Path == "/v1/jobs" && r.Method == http.MethodPut:
+		var req nomad.JobRegisterRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.registered = req.Job
+		_ = json.NewEncoder(w).Encode(nomad.JobRegisterResponse{JobModifyIndex: 2})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// testScheduler returns a scheduler talking to the fake Nomad API.
+func testScheduler(t *testing.T, f *fakeNomad) *Scheduler {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	nClient, err := nomad.NewClient(&nomad.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Scheduler{
+		config:    DefaultConfig(),
+		nomad:     nClient,
+		jobsAPI:   nClient.Jobs(),
+		pipelines: make(map[string]bool),
+	}
+}
+
+func TestDependencyPolicies(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        string
+		defaultPolicy string
+		allocs        []*nomad.AllocationListStub
+		wantReady     bool
+		wantSkipped   []string
+	}{
+		{
+			name:   "running",
+			policy: DependencyPolicyFail,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocRunning),
+			},
+		},
+		{
+			name:   "succeeded",
+			policy: DependencyPolicyFail,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocComplete),
+			},
+			wantReady: true,
+		},
+		{
+			name:   "fail",
+			policy: DependencyPolicyFail,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocFailed),
+				testAlloc("test", 0, allocComplete),
+			},
+		},
+		{
+			name:          "fail by default",
+			defaultPolicy: DependencyPolicyFail,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocFailed),
+				testAlloc("test", 0, allocComplete),
+			},
+		},
+		{
+			name:   "continue waits for the other groups",
+			policy: DependencyPolicyContinue,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocFailed),
+				testAlloc("test", 0, allocRunning),
+			},
+		},
+		{
+			name:   "continue",
+			policy: DependencyPolicyContinue,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocFailed),
+				testAlloc("test", 0, allocComplete),
+			},
+			wantReady: true,
+		},
+		{
+			name:   "skip waits for the other groups",
+			policy: DependencyPolicySkip,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocFailed),
+				testAlloc("test", 0, allocRunning),
+			},
+			wantSkipped: []string{"build"},
+		},
+		{
+			name:   "skip",
+			policy: DependencyPolicySkip,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocFailed),
+				testAlloc("test", 0, allocComplete),
+			},
+			wantReady:   true,
+			wantSkipped: []string{"build"},
+		},
+		{
+			name:          "skip by default",
+			defaultPolicy: DependencyPolicySkip,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocLost),
+				testAlloc("test", 0, allocComplete),
+			},
+			wantReady:   true,
+			wantSkipped: []string{"build"},
+		},
+		{
+			name:   "skip after success",
+			policy: DependencyPolicySkip,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocComplete),
+			},
+			wantReady:   true,
+			wantSkipped: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := map[string]string{TagDependencies: "build, test"}
+			if len(tt.policy) > 0 {
+				meta[TagDependencyPolicy] = tt.policy
+			}
+			deploy := testGroup("deploy", 0, meta)
+			job := testJob(nil, testGroup("build", 0, nil), testGroup("test", 0, nil), deploy)
+
+			if got := dependenciesReady(job, tt.allocs, deploy, tt.defaultPolicy); got != tt.wantReady {
+				t.Errorf("dependenciesReady() = %v, want %v", got, tt.wantReady)
+			}
+
+			if got := skippedDependencies(job, tt.allocs, deploy, tt.defaultPolicy); !reflect.DeepEqual(got, tt.wantSkipped) {
+				t.Errorf("skippedDependencies() = %v, want %v", got, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts map[string]int
+		policy string
+		allocs []*nomad.AllocationListStub
+		// want are the counts of the groups after the reconcile, nil if the
+		// job isn't updated
+		want        map[string]int
+		wantSkipped []string
+	}{
+		{
+			name:   "running",
+			counts: map[string]int{"build": 1},
+			allocs: []*nomad.AllocationListStub{testAlloc("build", 0, allocRunning)},
+		},
+		{
+			name:   "triggers next groups",
+			counts: map[string]int{"build": 1},
+			allocs: []*nomad.AllocationListStub{testAlloc("build", 0, allocComplete)},
+			want:   map[string]int{"build": 0, "test": 1, "lint": 1, "deploy": 0},
+		},
+		{
+			name:   "failed group doesn't trigger next groups",
+			counts: map[string]int{"build": 1},
+			allocs: []*nomad.AllocationListStub{testAlloc("build", 0, allocFailed)},
+		},
+		{
+			name:   "waits for all dependencies",
+			counts: map[string]int{"test": 1, "lint": 1},
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocComplete),
+				testAlloc("lint", 0, allocRunning),
+			},
+			want: map[string]int{"build": 0, "test": 0, "lint": 1, "deploy": 0},
+		},
+		{
+			name:   "triggers once all dependencies finished",
+			counts: map[string]int{"lint": 1},
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocComplete),
+				testAlloc("lint", 0, allocComplete),
+			},
+			want: map[string]int{"build": 0, "test": 0, "lint": 0, "deploy": 1},
+		},
+		{
+			name:   "fail policy",
+			counts: map[string]int{"lint": 1},
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocComplete),
+				testAlloc("lint", 0, allocFailed),
+			},
+		},
+		{
+			name:   "continue policy after the failed group finished last",
+			counts: map[string]int{"lint": 1},
+			policy: DependencyPolicyContinue,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocComplete),
+				testAlloc("lint", 0, allocFailed),
+			},
+			want: map[string]int{"build": 0, "test": 0, "lint": 0, "deploy": 1},
+		},
+		{
+			name:   "continue policy after the failed group finished first",
+			counts: map[string]int{"test": 1},
+			policy: DependencyPolicyContinue,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocComplete),
+				testAlloc("lint", 0, allocFailed),
+			},
+			want: map[string]int{"build": 0, "test": 0, "lint": 0, "deploy": 1},
+		},
+		{
+			name:   "skip policy",
+			counts: map[string]int{"lint": 1},
+			policy: DependencyPolicySkip,
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocComplete),
+				testAlloc("test", 0, allocComplete),
+				testAlloc("lint", 0, allocFailed),
+			},
+			want:        map[string]int{"build": 0, "test": 0, "lint": 0, "deploy": 0},
+			wantSkipped: []string{"deploy"},
+		},
+		{
+			name:   "releases the next batch",
+			counts: map[string]int{"build": 2},
+			allocs: []*nomad.AllocationListStub{
+				testAlloc("build", 0, allocFailed),
+				testAlloc("build", 1, allocRunning),
+			},
+			want: map[string]int{"build": 3, "test": 0, "lint": 0, "deploy": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			build := testGroup("build", tt.counts["build"], map[string]string{TagRoot: "true", TagNext: "test,lint"})
+			if *build.Count > 1 {
+				build.SetMeta(TagCount, "3")
+				build.SetMeta(TagParallelism, "2")
+				build.SetMeta(TagSuccessThreshold, "1")
+			}
+
+			deployMeta := map[string]string{TagDependencies: "test,lint"}
+			if len(tt.policy) > 0 {
+				deployMeta[TagDependencyPolicy] = tt.policy
+			}
+
+			job := testJob(map[string]string{TagScheduler: SchedulerServer},
+				build,
+				testGroup("test", tt.counts["test"], map[string]string{TagDependencies: "build", TagNext: "deploy"}),
+				testGroup("lint", tt.counts["lint"], map[string]string{TagDependencies: "build", TagNext: "deploy"}),
+				testGroup("deploy", tt.counts["deploy"], deployMeta),
+			)
+			job.JobModifyIndex = new(uint64)
+
+			f := &fakeNomad{job: job, allocs: tt.allocs}
+			s := testScheduler(t, f)
+
+			if err := s.reconcile(*job.ID); err != nil {
+				t.Fatalf("reconcile() error = %v", err)
+			}
+
+			if tt.want == nil {
+				if f.registered != nil {
+					t.Errorf("reconcile() updated the job, want no update")
+				}
+				return
+			}
+			if f.registered == nil {
+				t.Fatalf("reconcile() didn't update the job")
+			}
+
+			got := make(map[string]int)
+			skipped := make([]string, 0)
+			for _, tg := range f.registered.TaskGroups {
+				got[*tg.Name] = *tg.Count
+				if _, ok := tg.Meta[TagDependencySkip]; ok {
+					skipped = append(skipped, *tg.Name)
+				}
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("counts = %v, want %v", got, tt.want)
+			}
+			if len(tt.wantSkipped) == 0 {
+				tt.wantSkipped = []string{}
+			}
+			if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("skipped groups = %v, want %v", skipped, tt.wantSkipped)
+			}
+
+			if !s.pipelines[*job.ID] {
+				t.Errorf("reconcile() didn't track the job as a pipeline")
+			}
+		})
+	}
+}
+
+func TestReconcileIgnoresOtherJobs(t *testing.T) {
+	job := testJob(nil, testGroup("build", 1, map[string]string{TagNext: "test"}), testGroup("test", 0, nil))
+	job.JobModifyIndex = new(uint64)
+
+	f := &fakeNomad{job: job, allocs: []*nomad.AllocationListStub{testAlloc("build", 0, allocComplete)}}
+	s := testScheduler(t, f)
+	s.pipelines[*job.ID] = true
+
+	if err := s.reconcile(*job.ID); err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+
+	if f.registered != nil {
+		t.Error("reconcile() updated a job scheduled by its hooks")
+	}
+	if s.pipelines[*job.ID] {
+		t.Error("reconcile() kept tracking a job scheduled by its hooks")
+	}
+}
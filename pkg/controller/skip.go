@@ -0,0 +1,67 @@
+package controller
+
+import (
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Skipped checks if the group is skipped by the skip or only tags the job was
+// dispatched with. Instances of a matrix group are skipped with the group.
+func Skipped(job *nomad.Job, group string) bool {
+	names := []string{group}
+	if tg := job.LookupTaskGroup(group); tg != nil {
+		if mGroup := lookupMetaTagStr(tg.Meta, TagMatrixGroup); len(mGroup) > 0 {
+			names = append(names, mGroup)
+		}
+	}
+
+	contains := func(list []string) bool {
+		for _, item := range list {
+			for _, name := range names {
+				if item == name {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if skip := lookupMetaTagStr(job.Meta, TagSkip); len(skip) > 0 && contains(split(skip)) {
+		return true
+	}
+
+	only := lookupMetaTagStr(job.Meta, TagOnly)
+	return len(only) > 0 && !contains(split(only))
+}
+
+// skippedNext returns the next groups of a skipped group, triggered in its
+// place.
+func (pc *PipelineController) skippedNext(allocs []*nomad.AllocationListStub, tg *nomad.TaskGroup) []string {
+	next := make([]string, 0)
+
+	nextTag := lookupMetaTagStr(tg.Meta, TagNext)
+	if len(nextTag) == 0 {
+		return next
+	}
+
+	for _, group := range split(nextTag) {
+		// the server only triggers groups once their dependencies are done,
+		// otherwise the wait hook of the group takes care of it
+		nTG := pc.Job.LookupTaskGroup(group)
+		if nTG != nil && ServerScheduled(pc.Job) {
+			policy := pc.Config.Defaults.DependencyPolicy
+			if !dependenciesReady(pc.Job, allocs, nTG, policy) {
+				continue
+			}
+			if failed := skippedDependencies(pc.Job, allocs, nTG, policy); len(failed) > 0 {
+				log.Warnf("dependent task groups finished unsuccessfully, skipping group (%v): %v", group, failed)
+				skipGroup(nTG, failed)
+				continue
+			}
+		}
+
+		next = append(next, group)
+	}
+
+	return next
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+func TestSkipped(t *testing.T) {
+	tests := []struct {
+		name  string
+		meta  map[string]string
+		group string
+		want  bool
+	}{
+		{name: "no tags", group: "build"},
+		{name: "skip", meta: map[string]string{TagSkip: "lint, build"}, group: "build", want: true},
+		{name: "skip other group", meta: map[string]string{TagSkip: "lint"}, group: "build"},
+		{name: "only", meta: map[string]string{TagOnly: "build,deploy"}, group: "build"},
+		{name: "only other group", meta: map[string]string{TagOnly: "deploy"}, group: "build", want: true},
+		{name: "empty only", meta: map[string]string{TagOnly: ""}, group: "build"},
+		{name: "skip wins over only", meta: map[string]string{TagOnly: "build", TagSkip: "build"}, group: "build", want: true},
+		{name: "skip and only other groups", meta: map[string]string{TagOnly: "deploy", TagSkip: "lint"}, group: "build", want: true},
+		{name: "skip matrix group", meta: map[string]string{TagSkip: "test"}, group: "test-us", want: true},
+		{name: "only matrix group", meta: map[string]string{TagOnly: "test"}, group: "test-us"},
+		{name: "only matrix instance", meta: map[string]string{TagOnly: "test-eu"}, group: "test-us", want: true},
+		{name: "unknown group", meta: map[string]string{TagSkip: "missing"}, group: "missing", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := testJob(tt.meta,
+				testGroup("build", 0, nil),
+				testGroup("test-us", 0, map[string]string{TagMatrixGroup: "test"}),
+			)
+
+			if got := Skipped(job, tt.group); got != tt.want {
+				t.Errorf("Skipped(%v) = %v, want %v", tt.group, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkippedNext(t *testing.T) {
+	tests := []struct {
+		name        string
+		jobMeta     map[string]string
+		allocs      []*nomad.AllocationListStub
+		want        []string
+		wantSkipped bool
+	}{
+		{
+			name: "hooks",
+			want: []string{"test", "deploy"},
+		},
+		{
+			name:    "server waits for dependencies",
+			jobMeta: map[string]string{TagScheduler: SchedulerServer},
+			allocs:  []*nomad.AllocationListStub{testAlloc("build", 0, allocRunning)},
+			want:    []string{"test"},
+		},
+		{
+			name:    "server once dependencies finished",
+			jobMeta: map[string]string{TagScheduler: SchedulerServer},
+			allocs:  []*nomad.AllocationListStub{testAlloc("build", 0, allocComplete)},
+			want:    []string{"test", "deploy"},
+		},
+		{
+			name:        "server skips groups after failed dependencies",
+			jobMeta:     map[string]string{TagScheduler: SchedulerServer},
+			allocs:      []*nomad.AllocationListStub{testAlloc("build", 0, allocFailed)},
+			want:        []string{"test"},
+			wantSkipped: true,
+		},
+		{
+			name:    "server with dependencies left out by only",
+			jobMeta: map[string]string{TagScheduler: SchedulerServer, TagOnly: "lint,test,deploy"},
+			want:    []string{"test", "deploy"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deploy := testGroup("deploy", 0, map[string]string{
+				TagDependencies:     "build",
+				TagDependencyPolicy: DependencyPolicySkip,
+			})
+			lint := testGroup("lint", 0, map[string]string{TagNext: "test,deploy"})
+			job := testJob(tt.jobMeta, lint, testGroup("build", 0, nil), testGroup("test", 0, nil), deploy)
+
+			pc := PipelineController{Job: job, Config: DefaultConfig()}
+
+			if got := pc.skippedNext(tt.allocs, lint); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("skippedNext() = %v, want %v", got, tt.want)
+			}
+
+			if _, skipped := deploy.Meta[TagDependencySkip]; skipped != tt.wantSkipped {
+				t.Errorf("deploy skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
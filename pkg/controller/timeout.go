@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// TimeoutWatcher enforces the pipeline timeout (see TagTimeout) and group
+// timeouts (see TagGroupTimeout) of running pipeline jobs. When a timeout is
+// hit, the overrunning groups are stopped, marked as timed out and the groups
+// in the on-timeout tag (see TagOnTimeout) are triggered.
+type TimeoutWatcher struct {
+	PollInterval time.Duration
+
+	nomad   *nomad.Client
+	jobsAPI *nomad.Jobs
+	config  *Config
+}
+
+func NewTimeoutWatcher(config *Config) (*TimeoutWatcher, error) {
+	nClient, err := config.Nomad.NewClient()
+	if err != nil {
+		return nil, fmt.Errorf("error creating client: %w", err)
+	}
+
+	w := TimeoutWatcher{
+		PollInterval: 30 * time.Second,
+		nomad:        nClient,
+		jobsAPI:      nClient.Jobs(),
+		config:       config,
+	}
+
+	return &w, nil
+}
+
+// Run checks the timeouts of all running pipeline jobs every poll interval,
+// until the context is done.
+func (w *TimeoutWatcher) Run(ctx context.Context) error {
+	log.Info("starting pipeline timeout watcher")
+
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		w.checkAll()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *TimeoutWatcher) checkAll() {
+	jobs, _, err := w.jobsAPI.List(&nomad.QueryOptions{})
+	if err != nil {
+		log.Errorf("error listing jobs: %v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		if job.ParameterizedJob || job.Status == "dead" {
+			continue
+		}
+
+		err = w.check(job.ID)
+		if err != nil {
+			log.Errorf("error checking timeouts of job (%v): %v", job.ID, err)
+		}
+	}
+}
+
+// allocsStart returns when the earliest of the allocations was created, zero
+// if there are none.
+func allocsStart(allocs []*nomad.AllocationListStub) time.Time {
+	var start time.Time
+	for _, alloc := range allocs {
+		created := time.Unix(0, alloc.CreateTime)
+		if start.IsZero() || created.Before(start) {
+			start = created
+		}
+	}
+	return start
+}
+
+func (w *TimeoutWatcher) check(jobID string) error {
+	job, _, err := w.jobsAPI.Info(jobID, &nomad.QueryOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting job: %w", err)
+	}
+
+	if _, ok := job.Meta[TagEnabled]; !ok {
+		return nil
+	}
+
+	// a timed out pipeline has already been stopped
+	if len(lookupMetaTagStr(job.Meta, TagTimedOut)) > 0 {
+		return nil
+	}
+
+	jAllocs, _, err := w.jobsAPI.Allocations(jobID, true, &nomad.QueryOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting job allocations: %w", err)
+	}
+
+	if len(jAllocs) == 0 {
+		return nil
+	}
+
+	pc := PipelineController{
+		JobID:     jobID,
+		Job:       job,
+		Nomad:     w.nomad,
+		JobsAPI:   w.jobsAPI,
+		AllocsAPI: w.nomad.Allocations(),
+		Config:    w.config,
+	}
+
+	now := time.Now()
+
+	timeout, err := lookupMetaTagDuration(job.Meta, TagTimeout)
+	if err != nil {
+		log.Warnf("error parsing timeout of job (%v), ignoring it: %v", jobID, err)
+	}
+	if timeout > 0 && now.Sub(allocsStart(jAllocs)) > timeout {
+		log.Warnf("pipeline timed out after %v, stopping all groups (job: %v)", timeout, jobID)
+
+		for _, tg := range job.TaskGroups {
+			tg.Count = i2p(0)
+		}
+		job.SetMeta(TagTimedOut, fmt.Sprintf("pipeline timed out after %v", timeout))
+
+		if onTimeout := lookupMetaTagStr(job.Meta, TagOnTimeout); len(onTimeout) > 0 {
+			log.Infof("triggering on-timeout groups (job: %v): %v", jobID, onTimeout)
+			pc.triggerGroups(jAllocs, split(onTimeout), nil, nil)
+		}
+
+		return pc.UpdateJob()
+	}
+
+	update := false
+	for _, tg := range job.TaskGroups {
+		if tg.Count == nil || *tg.Count == 0 || len(lookupMetaTagStr(tg.Meta, TagTimedOut)) > 0 {
+			continue
+		}
+
+		tags := GroupTags(job, tg)
+
+		gTimeout, err := lookupMetaTagDuration(tags, TagGroupTimeout)
+		if err != nil {
+			log.Warnf("error parsing timeout of group (%v), ignoring it: %v", *tg.Name, err)
+			continue
+		}
+		if gTimeout <= 0 {
+			continue
+		}
+
+		gAllocs := make([]*nomad.AllocationListStub, 0)
+		for _, alloc := range latestAllocs(jAllocs) {
+			if alloc.TaskGroup == *tg.Name {
+				gAllocs = append(gAllocs, alloc)
+			}
+		}
+
+		if len(gAllocs) == 0 || TgDone(jAllocs, []string{*tg.Name}, false) {
+			continue
+		}
+
+		if now.Sub(allocsStart(gAllocs)) <= gTimeout {
+			continue
+		}
+
+		log.Warnf("group timed out after %v, stopping it (job: %v, group: %v)", gTimeout, jobID, *tg.Name)
+
+		// the group is marked instead of the job, changing the job meta would
+		// restart all running groups
+		tg.Count = i2p(0)
+		tg.SetMeta(TagTimedOut, fmt.Sprintf("group timed out after %v", gTimeout))
+		update = true
+
+		if onTimeout := lookupMetaTagStr(tags, TagOnTimeout); len(onTimeout) > 0 {
+			log.Infof("triggering on-timeout groups (job: %v, group: %v): %v", jobID, *tg.Name, onTimeout)
+			pc.triggerGroups(jAllocs, split(onTimeout), nil, nil)
+		}
+	}
+
+	if !update {
+		return nil
+	}
+
+	return pc.UpdateJob()
+}
+
+// TimedOut returns why the pipeline or any of its groups timed out, empty if
+// none did.
+func TimedOut(job *nomad.Job) string {
+	if reason := lookupMetaTagStr(job.Meta, TagTimedOut); len(reason) > 0 {
+		return reason
+	}
+
+	for _, tg := range job.TaskGroups {
+		if reason := lookupMetaTagStr(tg.Meta, TagTimedOut); len(reason) > 0 {
+			return fmt.Sprintf("%v: %v", *tg.Name, reason)
+		}
+	}
+
+	return ""
+}
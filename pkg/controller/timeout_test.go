@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+func TestTimeoutCheck(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		jobMeta   map[string]string
+		buildMeta map[string]string
+		status    string
+		started   time.Duration
+		// want are the counts of the groups after the check, nil if the job
+		// isn't updated
+		want         map[string]int
+		wantTimedOut []string
+	}{
+		{
+			name:    "no timeout",
+			status:  allocRunning,
+			started: 24 * time.Hour,
+		},
+		{
+			name:    "pipeline within timeout",
+			jobMeta: map[string]string{TagTimeout: "1h"},
+			status:  allocRunning,
+			started: 10 * time.Minute,
+		},
+		{
+			name:         "pipeline timed out",
+			jobMeta:      map[string]string{TagTimeout: "1h", TagOnTimeout: "cleanup"},
+			status:       allocRunning,
+			started:      2 * time.Hour,
+			want:         map[string]int{"build": 0, "test": 0, "cleanup": 1},
+			wantTimedOut: []string{"job"},
+		},
+		{
+			name:    "pipeline already timed out",
+			jobMeta: map[string]string{TagTimeout: "1h", TagTimedOut: "pipeline timed out after 1h0m0s"},
+			status:  allocRunning,
+			started: 2 * time.Hour,
+		},
+		{
+			name:      "group within timeout",
+			buildMeta: map[string]string{TagGroupTimeout: "30m"},
+			status:    allocRunning,
+			started:   10 * time.Minute,
+		},
+		{
+			name:         "group timed out",
+			buildMeta:    map[string]string{TagGroupTimeout: "30m", TagOnTimeout: "cleanup"},
+			status:       allocRunning,
+			started:      time.Hour,
+			want:         map[string]int{"build": 0, "test": 0, "cleanup": 1},
+			wantTimedOut: []string{"build"},
+		},
+		{
+			name:         "group timed out by default",
+			jobMeta:      map[string]string{TagDefaultsPrefix + "group-timeout": "30m"},
+			status:       allocRunning,
+			started:      time.Hour,
+			want:         map[string]int{"build": 0, "test": 0, "cleanup": 0},
+			wantTimedOut: []string{"build"},
+		},
+		{
+			name:      "group finished after its timeout",
+			buildMeta: map[string]string{TagGroupTimeout: "30m"},
+			status:    allocComplete,
+			started:   time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := testJob(tt.jobMeta,
+				testGroup("build", 1, tt.buildMeta),
+				testGroup("test", 0, nil),
+				testGroup("cleanup", 0, nil),
+			)
+			job.JobModifyIndex = new(uint64)
+
+			alloc := testAlloc("build", 0, tt.status)
+			alloc.CreateTime = now.Add(-tt.started).UnixNano()
+
+			f := &fakeNomad{job: job, allocs: []*nomad.AllocationListStub{alloc}}
+			s := testScheduler(t, f)
+			w := TimeoutWatcher{nomad: s.nomad, jobsAPI: s.jobsAPI, config: s.config}
+
+			if err := w.check(*job.ID); err != nil {
+				t.Fatalf("check() error = %v", err)
+			}
+
+			if tt.want == nil {
+				if f.registered != nil {
+					t.Errorf("check() updated the job, want no update")
+				}
+				return
+			}
+			if f.registered == nil {
+				t.Fatalf("check() didn't update the job")
+			}
+
+			got := make(map[string]int)
+			timedOut := make([]string, 0)
+			if _, ok := f.registered.Meta[TagTimedOut]; ok {
+				timedOut = append(timedOut, "job")
+			}
+			for _, tg := range f.registered.TaskGroups {
+				got[*tg.Name] = *tg.Count
+				if _, ok := tg.Meta[TagTimedOut]; ok {
+					timedOut = append(timedOut, *tg.Name)
+				}
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("counts = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(timedOut, tt.wantTimedOut) {
+				t.Errorf("timed out = %v, want %v", timedOut, tt.wantTimedOut)
+			}
+			if len(TimedOut(f.registered)) == 0 {
+				t.Errorf("TimedOut() is empty for a timed out job")
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TracerName = "github.com/hyperbadger/nomad-pipeline"
+
+	// env var holding the trace context of the group, in the W3C
+	// traceparent format
+	traceparentEnvVar = "TRACEPARENT"
+)
+
+// runHash is what the trace and span IDs of a run are derived from, so that
+// the server and all hooks of a run agree on them without having to store
+// them.
+func runHash(jobID string, createIndex uint64, group string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(fmt.Sprintf("%s@%d/%s", jobID, createIndex, group)))
+}
+
+// RunTraceID returns the trace ID of a run of the job.
+func RunTraceID(jobID string, createIndex uint64) trace.TraceID {
+	var id trace.TraceID
+	h := runHash(jobID, createIndex, "")
+	copy(id[:], h[:])
+	return id
+}
+
+// RunSpanID returns the ID of the root span of a run of the job.
+func RunSpanID(jobID string, createIndex uint64) trace.SpanID {
+	var id trace.SpanID
+	h := runHash(jobID, createIndex, "")
+	copy(id[:], h[len(h)-len(id):])
+	return id
+}
+
+// GroupSpanID returns the ID of the span of a group in a run of the job.
+func GroupSpanID(jobID string, createIndex uint64, group string) trace.SpanID {
+	var id trace.SpanID
+	h := runHash(jobID, createIndex, group)
+	copy(id[:], h[:])
+	return id
+}
+
+func groupTraceparent(job *nomad.Job, group string) string {
+	var createIndex uint64
+	if job.CreateIndex != nil {
+		createIndex = *job.CreateIndex
+	}
+
+	return fmt.Sprintf("00-%s-%s-01", RunTraceID(*job.ID, createIndex), GroupSpanID(*job.ID, createIndex, group))
+}
+
+// addTraceparent passes the trace context of the group to all of its tasks,
+// tasks that already have one keep it.
+func addTraceparent(job *nomad.Job, tg *nomad.TaskGroup) {
+	traceparent := groupTraceparent(job, *tg.Name)
+
+	for _, task := range tg.Tasks {
+		if task.Env == nil {
+			task.Env = make(map[string]string)
+		}
+		if _, ok := task.Env[traceparentEnvVar]; ok {
+			continue
+		}
+		task.Env[traceparentEnvVar] = traceparent
+	}
+}
+
+type spanIDsKey struct{}
+
+type spanIDs struct {
+	traceID trace.TraceID
+	spanID  trace.SpanID
+}
+
+// WithSpanIDs sets the IDs of the next span started with the context, spans
+// of a run are recorded after the fact with the IDs derived from the job.
+func WithSpanIDs(ctx context.Context, traceID trace.TraceID, spanID trace.SpanID) context.Context {
+	return context.WithValue(ctx, spanIDsKey{}, spanIDs{traceID: traceID, spanID: spanID})
+}
+
+// idGenerator uses the IDs set with WithSpanIDs, random ones otherwise.
+type idGenerator struct{}
+
+func randomIDs() (trace.TraceID, trace.SpanID) {
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	_, _ = rand.Read(traceID[:])
+	_, _ = rand.Read(spanID[:])
+	return traceID, spanID
+}
+
+func (idGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	if ids, ok := ctx.Value(spanIDsKey{}).(spanIDs); ok {
+		return ids.traceID, ids.spanID
+	}
+	return randomIDs()
+}
+
+func (idGenerator) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	if ids, ok := ctx.Value(spanIDsKey{}).(spanIDs); ok && ids.traceID == traceID {
+		return ids.spanID
+	}
+	_, spanID := randomIDs()
+	return spanID
+}
+
+// InitTracing sets up the global tracer provider to export spans to the OTLP
+// collector. The returned func flushes any pending spans, it is a no-op if
+// tracing isn't enabled.
+func InitTracing(ctx context.Context, cfg TracingConfig, component string) (func(context.Context) error, error) {
+	if !cfg.Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace exporter: %w", err)
+	}
+
+	res := resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String("nomad-pipeline"),
+		attribute.String("nomad_pipeline.component", component),
+	)
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithIDGenerator(idGenerator{}),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return tp.Shutdown, nil
+}
+
+// TraceHook starts a span for the agent hook, as a child of the span of its
+// group. The returned func ends the span and flushes it to the collector.
+func (pc *PipelineController) TraceHook(hook string) func(success bool) {
+	shutdown, err := InitTracing(context.Background(), pc.Config.Tracing, "agent")
+	if err != nil {
+		log.Warnf("error setting up tracing: %v", err)
+		return func(bool) {}
+	}
+
+	carrier := propagation.MapCarrier{"traceparent": os.Getenv(traceparentEnvVar)}
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), carrier)
+
+	// the init task doesn't get a traceparent, its span is a child of the
+	// span of the run
+	if !trace.SpanContextFromContext(ctx).IsValid() && pc.Job != nil {
+		var createIndex uint64
+		if pc.Job.CreateIndex != nil {
+			createIndex = *pc.Job.CreateIndex
+		}
+
+		ctx = trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    RunTraceID(pc.JobID, createIndex),
+			SpanID:     RunSpanID(pc.JobID, createIndex),
+			TraceFlags: trace.FlagsSampled,
+			Remote:     true,
+		}))
+	}
+
+	_, span := otel.Tracer(TracerName).Start(ctx, hook,
+		trace.WithAttributes(
+			attribute.String("nomad.job_id", pc.JobID),
+			attribute.String("nomad.group", pc.GroupName),
+			attribute.String("nomad.alloc_id", pc.AllocID),
+		),
+	)
+
+	return func(success bool) {
+		if !success {
+			span.SetStatus(codes.Error, "hook failed")
+		}
+		span.End()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdown(ctx); err != nil {
+			log.Warnf("error flushing spans: %v", err)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// parseMetaList parses a comma separated list of key=value pairs.
+func parseMetaList(list string) (map[string]string, error) {
+	meta := make(map[string]string)
+
+	for _, pair := range split(list) {
+		if len(pair) == 0 {
+			continue
+		}
+
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("meta (%v) is not a key=value pair", pair)
+		}
+
+		meta[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return meta, nil
+}
+
+// waitsOnChild checks if the group is only done once the pipeline it
+// triggers has finished, see TagTriggerPipelineWait.
+func waitsOnChild(tg *nomad.TaskGroup) bool {
+	if len(lookupMetaTagStr(tg.Meta, TagTriggerPipeline)) == 0 {
+		return false
+	}
+
+	wait, err := lookupMetaTagBool(tg.Meta, TagTriggerPipelineWait)
+	if err != nil {
+		log.Warnf("error parsing trigger pipeline wait tag, defaulting to false: %v", err)
+	}
+	return wait
+}
+
+// childPending checks if any allocation of a group waiting on the pipeline it
+// triggers is still waiting, the next hook does the waiting.
+func childPending(tg *nomad.TaskGroup, allocs []*nomad.AllocationListStub) bool {
+	if !waitsOnChild(tg) {
+		return false
+	}
+
+	for _, alloc := range latestAllocs(allocs) {
+		if alloc.TaskGroup != *tg.Name {
+			continue
+		}
+
+		state, ok := alloc.TaskStates["next"]
+		if !ok || state.State != "dead" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// childFailed checks if the next hook of a group waiting on the pipeline it
+// triggers failed, which happens when the triggered pipeline fails.
+func childFailed(tg *nomad.TaskGroup, allocs []*nomad.AllocationListStub) bool {
+	if !waitsOnChild(tg) {
+		return false
+	}
+
+	for _, alloc := range latestAllocs(allocs) {
+		if alloc.TaskGroup != *tg.Name {
+			continue
+		}
+
+		if state, ok := alloc.TaskStates["next"]; ok && state.Failed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DispatchPipeline dispatches the parameterized pipeline with the meta. The
+// current job is recorded as the parent of the dispatched job, if the
+// pipeline allows the TagParentJob meta. Meta the pipeline doesn't allow is
+// dropped, as Nomad would refuse the dispatch.
+func (pc *PipelineController) DispatchPipeline(pipelineID string, meta map[string]string) (string, error) {
+	pipeline, _, err := pc.JobsAPI.Info(pipelineID, &nomad.QueryOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error getting pipeline: %w", err)
+	}
+
+	if !pipeline.IsParameterized() {
+		return "", fmt.Errorf("pipeline (%v) is not a parameterized job", pipelineID)
+	}
+
+	allowed := make(map[string]bool)
+	for _, k := range pipeline.ParameterizedJob.MetaRequired {
+		allowed[k] = true
+	}
+	for _, k := range pipeline.ParameterizedJob.MetaOptional {
+		allowed[k] = true
+	}
+
+	dMeta := make(map[string]string)
+	for k, v := range meta {
+		if !allowed[k] {
+			log.Warnf("meta (%v) isn't allowed by pipeline (%v), not passing it", k, pipelineID)
+			continue
+		}
+		dMeta[k] = v
+	}
+
+	if allowed[TagParentJob] {
+		dMeta[TagParentJob] = pc.JobID
+	} else {
+		log.Infof("pipeline (%v) doesn't allow the %v meta, the parent job won't be recorded on the dispatched job", pipelineID, TagParentJob)
+	}
+
+	resp, _, err := pc.JobsAPI.Dispatch(pipelineID, dMeta, nil, &nomad.WriteOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error dispatching pipeline: %w", err)
+	}
+
+	log.Infof("dispatched pipeline (%v): %v", pipelineID, resp.DispatchedJobID)
+
+	return resp.DispatchedJobID, nil
+}
+
+// WaitPipeline blocks until the dispatched pipeline job has finished, an error
+// is returned if it didn't finish successfully.
+func (pc *PipelineController) WaitPipeline(ctx context.Context, jobID string) error {
+	log.Infof("waiting for pipeline job to finish: %v", jobID)
+
+	var index uint64
+	failures := 0
+	for {
+		q := &nomad.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  5 * time.Minute,
+		}
+
+		job, meta, err := pc.JobsAPI.Info(jobID, q.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			failures++
+			if pc.Config.Retry.MaxRetries > 0 && failures > pc.Config.Retry.MaxRetries {
+				return fmt.Errorf("too many errors getting pipeline job: %w", err)
+			}
+
+			backoff := BackoffDuration(pc.Config.Retry.MinBackoff, pc.Config.Retry.MaxBackoff, failures)
+			log.Warnf("error getting pipeline job, retrying in %v: %v", backoff, err)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			continue
+		}
+
+		failures = 0
+		index = meta.LastIndex
+
+		if job.Status != nil && *job.Status == "dead" {
+			return pc.pipelineResult(job)
+		}
+	}
+}
+
+func (pc *PipelineController) pipelineResult(job *nomad.Job) error {
+	if reason := TimedOut(job); len(reason) > 0 {
+		return fmt.Errorf("pipeline job (%v) timed out: %v", *job.ID, reason)
+	}
+
+	allocs, _, err := pc.JobsAPI.Allocations(*job.ID, true, &nomad.QueryOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting pipeline job allocations: %w", err)
+	}
+
+	groups := make([]string, 0)
+	for _, tg := range job.TaskGroups {
+		if tgAllocated(allocs, []string{*tg.Name}) {
+			groups = append(groups, *tg.Name)
+		}
+	}
+
+	if failed := TgFailed(job, allocs, groups); len(failed) > 0 {
+		return fmt.Errorf("pipeline job (%v) finished with failed task groups: %v", *job.ID, failed)
+	}
+
+	log.Infof("pipeline job finished successfully: %v", *job.ID)
+
+	return nil
+}
+
+// childJobFile is where the job dispatched under the given name is remembered,
+// relative to NOMAD_ALLOC_DIR.
+func childJobFile(name string) string {
+	return filepath.Join(os.Getenv("NOMAD_ALLOC_DIR"), "nomad-pipeline", "child-"+name)
+}
+
+// readChildJob returns the job dispatched under the given name, empty if none
+// was.
+func readChildJob(name string) (string, error) {
+	idBytes, err := os.ReadFile(childJobFile(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(idBytes)), nil
+}
+
+// childPipeline dispatches the pipeline, and waits for it to finish if wait is
+// set. The dispatched job is remembered in the alloc dir under the given name,
+// so a restarted task picks up the same job instead of dispatching again.
+func (pc *PipelineController) childPipeline(ctx context.Context, name, pipelineID string, meta map[string]string, wait bool) (string, error) {
+	jobID, err := readChildJob(name)
+	if err != nil {
+		return "", fmt.Errorf("error reading dispatched job: %w", err)
+	}
+	if len(jobID) > 0 {
+		log.Infof("pipeline already dispatched: %v", jobID)
+	}
+
+	if len(jobID) == 0 {
+		jobID, err = pc.DispatchPipeline(pipelineID, meta)
+		if err != nil {
+			return "", err
+		}
+
+		p := childJobFile(name)
+
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+		if err == nil {
+			err = os.WriteFile(p, []byte(jobID), 0644)
+		}
+		if err != nil {
+			log.Warnf("error saving dispatched job, a restart will dispatch again: %v", err)
+		}
+	}
+
+	if !wait {
+		return jobID, nil
+	}
+
+	return jobID, pc.WaitPipeline(ctx, jobID)
+}
+
+// triggerPipeline dispatches the pipeline set in the trigger pipeline tag of
+// the current group, passing the meta of the trigger pipeline meta tag and
+// the outputs of the group.
+func (pc *PipelineController) triggerPipeline(cGroup *nomad.TaskGroup, outputs map[string]string) (string, error) {
+	pipelineID := lookupMetaTagStr(cGroup.Meta, TagTriggerPipeline)
+
+	meta, err := parseMetaList(lookupMetaTagStr(cGroup.Meta, TagTriggerPipelineMeta))
+	if err != nil {
+		return "", fmt.Errorf("error parsing trigger pipeline meta tag: %w", err)
+	}
+
+	for k, v := range outputs {
+		if _, ok := meta[k]; !ok {
+			meta[k] = v
+		}
+	}
+
+	return pc.childPipeline(context.Background(), "trigger", pipelineID, meta, waitsOnChild(cGroup))
+}
+
+// RunPipeline dispatches the pipeline of the current sub-pipeline group (see
+// TagPipeline) and blocks until it finishes, an error is returned if it
+// didn't finish successfully.
+func (pc *PipelineController) RunPipeline(ctx context.Context) error {
+	cGroup := pc.Job.LookupTaskGroup(pc.GroupName)
+	if cGroup == nil {
+		return fmt.Errorf("could not find current group: %v", pc.GroupName)
+	}
+
+	pipelineID := lookupMetaTagStr(cGroup.Meta, TagPipeline)
+	if len(pipelineID) == 0 {
+		return fmt.Errorf("group (%v) doesn't have a pipeline tag (%v)", pc.GroupName, TagPipeline)
+	}
+
+	meta, err := parseMetaList(lookupMetaTagStr(cGroup.Meta, TagPipelineMeta))
+	if err != nil {
+		return fmt.Errorf("error parsing pipeline meta tag: %w", err)
+	}
+
+	_, err = pc.childPipeline(ctx, "pipeline", pipelineID, meta, true)
+	return err
+}
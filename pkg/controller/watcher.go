@@ -0,0 +1,296 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// AllocWatcherFunc is called with the latest allocations of the job every time
+// they change. Watching stops once it returns true.
+type AllocWatcherFunc func(allocs []*nomad.AllocationListStub) (bool, error)
+
+// WatcherStats holds counters about the health of an AllocWatcher.
+type WatcherStats struct {
+	Reconnects    uint64
+	StreamErrors  uint64
+	PollFallbacks uint64
+}
+
+// AllocWatcher follows the allocations of a job. It uses the event stream
+// and resumes from the last seen index when the stream breaks, backing off
+// exponentially between attempts. If the event stream is disabled or denied
+// by ACLs, it falls back to blocking queries against the job allocations.
+type AllocWatcher struct {
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	MaxRetries   int
+	PollWaitTime time.Duration
+
+	nomad *nomad.Client
+	job   *nomad.Job
+	jobID string
+
+	index    uint64
+	allocs   map[string]*nomad.AllocationListStub
+	failures int
+	stats    WatcherStats
+}
+
+func NewAllocWatcher(nClient *nomad.Client, job *nomad.Job) *AllocWatcher {
+	w := AllocWatcher{
+		MinBackoff:   time.Second,
+		MaxBackoff:   time.Minute,
+		MaxRetries:   10,
+		PollWaitTime: 5 * time.Minute,
+		nomad:        nClient,
+		job:          job,
+		jobID:        *job.ID,
+		allocs:       make(map[string]*nomad.AllocationListStub),
+	}
+
+	return &w
+}
+
+// Stats returns a snapshot of the watcher counters.
+func (w *AllocWatcher) Stats() WatcherStats {
+	return WatcherStats{
+		Reconnects:    atomic.LoadUint64(&w.stats.Reconnects),
+		StreamErrors:  atomic.LoadUint64(&w.stats.StreamErrors),
+		PollFallbacks: atomic.LoadUint64(&w.stats.PollFallbacks),
+	}
+}
+
+// Watch calls fn with the current allocations of the job and then again every
+// time they change, until fn returns true, the context is done or too many
+// consecutive errors happen.
+func (w *AllocWatcher) Watch(ctx context.Context, fn AllocWatcherFunc) error {
+	err := w.refresh(ctx, 0)
+	if err != nil {
+		return fmt.Errorf("error getting job allocations: %w", err)
+	}
+
+	if ok, err := fn(w.list()); ok {
+		return err
+	}
+
+	defer func() {
+		stats := w.Stats()
+		log.Debugf("watcher stats, reconnects: %v, stream errors: %v, poll fallbacks: %v", stats.Reconnects, stats.StreamErrors, stats.PollFallbacks)
+	}()
+
+	polling := false
+	for {
+		var done bool
+
+		if polling {
+			done, err = w.poll(ctx, fn)
+		} else {
+			done, err = w.stream(ctx, fn)
+		}
+		if done {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !polling && streamUnavailable(err) {
+			log.Warnf("event stream unavailable, falling back to polling: %v", err)
+			atomic.AddUint64(&w.stats.PollFallbacks, 1)
+			eventStreamPollFallbacks.Inc()
+			polling = true
+			w.failures = 0
+			continue
+		}
+
+		w.failures++
+		if w.MaxRetries > 0 && w.failures > w.MaxRetries {
+			return fmt.Errorf("too many errors watching allocations: %w", err)
+		}
+
+		backoff := BackoffDuration(w.MinBackoff, w.MaxBackoff, w.failures)
+		log.Warnf("error watching allocations, retrying in %v: %v", backoff, err)
+		atomic.AddUint64(&w.stats.Reconnects, 1)
+		eventStreamReconnects.Inc()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// BackoffDuration doubles min for every consecutive failure, up to max.
+func BackoffDuration(min, max time.Duration, failures int) time.Duration {
+	backoff := min
+	for i := 1; i < failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+func (w *AllocWatcher) list() []*nomad.AllocationListStub {
+	allocs := make([]*nomad.AllocationListStub, 0, len(w.allocs))
+	for _, alloc := range w.allocs {
+		allocs = append(allocs, alloc)
+	}
+	return allocs
+}
+
+// refresh replaces the known allocations with the ones from a (blocking)
+// query to the job allocations endpoint.
+func (w *AllocWatcher) refresh(ctx context.Context, waitIndex uint64) error {
+	q := &nomad.QueryOptions{
+		WaitIndex: waitIndex,
+		WaitTime:  w.PollWaitTime,
+	}
+
+	allocs, meta, err := w.nomad.Jobs().Allocations(w.jobID, true, q.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	w.allocs = make(map[string]*nomad.AllocationListStub, len(allocs))
+	for _, alloc := range allocs {
+		w.allocs[alloc.ID] = alloc
+	}
+
+	if meta.LastIndex > w.index {
+		w.index = meta.LastIndex
+	}
+
+	return nil
+}
+
+func (w *AllocWatcher) poll(ctx context.Context, fn AllocWatcherFunc) (bool, error) {
+	for {
+		log.Debugf("polling allocations from index: %v", w.index)
+
+		err := w.refresh(ctx, w.index)
+		if err != nil {
+			return false, err
+		}
+
+		w.failures = 0
+
+		if ok, err := fn(w.list()); ok {
+			return true, err
+		}
+	}
+}
+
+func (w *AllocWatcher) stream(ctx context.Context, fn AllocWatcherFunc) (bool, error) {
+	sCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	topics := map[nomad.Topic][]string{
+		nomad.TopicAllocation: {w.jobID},
+	}
+
+	log.Debugf("subscribing to event stream from index: %v", w.index)
+
+	eCh, err := w.nomad.EventStream().Stream(sCtx, topics, w.index, &nomad.QueryOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case es, ok := <-eCh:
+			if !ok {
+				return false, errors.New("event stream closed")
+			}
+			if es.Err != nil {
+				atomic.AddUint64(&w.stats.StreamErrors, 1)
+				return false, fmt.Errorf("error in event stream: %w", es.Err)
+			}
+
+			w.failures = 0
+
+			for _, e := range es.Events {
+				log.Debugf("==> idx: %v, topic: %v, type: %v", e.Index, e.Topic, e.Type)
+
+				if e.Index > w.index {
+					w.index = e.Index
+				}
+
+				if e.Type != "AllocationUpdated" {
+					continue
+				}
+
+				alloc, err := e.Allocation()
+				if err != nil {
+					log.Errorf("error getting allocation from event stream: %v", err)
+					atomic.AddUint64(&w.stats.StreamErrors, 1)
+					continue
+				}
+				if alloc == nil {
+					log.Errorf("allocation in event stream shouldn't be nil")
+					atomic.AddUint64(&w.stats.StreamErrors, 1)
+					continue
+				}
+
+				log.Debugf("  |-> task group: %v, client status: %v", alloc.TaskGroup, alloc.ClientStatus)
+				for t, ts := range alloc.TaskStates {
+					log.Debugf("  |-> task: %v, state: %v, restarts: %v, failed: %v", t, ts.State, ts.Restarts, ts.Failed)
+				}
+
+				// workaround for alloc.Stub() to work
+				alloc.Job = w.job
+
+				allocStub := alloc.Stub()
+
+				// keep the job version the allocation was created with
+				if prev, ok := w.allocs[alloc.ID]; ok {
+					allocStub.JobVersion = prev.JobVersion
+				}
+
+				w.allocs[alloc.ID] = allocStub
+
+				log.Debugf("alloc store size %v", len(w.allocs))
+
+				if ok, err := fn(w.list()); ok {
+					return true, err
+				}
+			}
+		}
+	}
+}
+
+// streamUnavailable checks if the error is caused by the event stream being
+// disabled on the servers or denied by ACLs, retrying won't help in this case.
+func streamUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	for _, s := range []string{
+		"response code: 403",
+		"response code: 404",
+		"response code: 501",
+		"permission denied",
+		"event broker disabled",
+		"event stream disabled",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+
+	return false
+}